@@ -15,22 +15,147 @@ verifyEvents.addEventListener('message', e => {
   });
 });
 
+// messages are ordered by clock, then sender and then ID (the same order the server uses)
+const compareMessages = (a, b) => {
+  if (a.clock != b.clock) {
+    return a.clock - b.clock;
+  }
+  if (a.sender.uuid != b.sender.uuid) {
+    return a.sender.uuid < b.sender.uuid ? -1 : 1;
+  }
+  return a.id < b.id ? -1 : a.id > b.id ? 1 : 0;
+};
+
 let messageEvents = new EventSource('/api/events?stream=messages');
 messageEvents.addEventListener('message', e => {
   let m = JSON.parse(e.data);
-  m.id = e.data.lastEventId;
 
   if (!state.messages[m.room]) {
-    state.messages[m.room] = [];
+    Vue.set(state.messages, m.room, []);
   }
-  console.log(m);
-  state.messages[m.room].push(m);
+  const messages = state.messages[m.room];
+  let i = messages.length;
+  while (i > 0 && compareMessages(messages[i - 1], m) > 0) {
+    i--;
+  }
+  messages.splice(i, 0, m);
 });
 
-setInterval(() => {
+const replaceMessage = e => {
+  let m = JSON.parse(e.data);
+
+  const messages = state.messages[m.room] || [];
+  const i = messages.findIndex(old => old.id == m.id);
+  if (i != -1) {
+    Vue.set(messages, i, m);
+  }
+};
+messageEvents.addEventListener('edit', replaceMessage);
+messageEvents.addEventListener('delete', replaceMessage);
+messageEvents.addEventListener('expire', e => {
+  let m = JSON.parse(e.data);
+
+  const messages = state.messages[m.room] || [];
+  const i = messages.findIndex(old => old.id == m.id);
+  if (i != -1) {
+    messages.splice(i, 1);
+  }
+});
+messageEvents.addEventListener('reaction', e => {
+  let r = JSON.parse(e.data);
+
+  const m = (state.messages[r.room] || []).find(m => m.id == r.message);
+  if (!m) {
+    return;
+  }
+  if (!m.reactions) {
+    Vue.set(m, 'reactions', {});
+  }
+  if (r.count == 0) {
+    Vue.delete(m.reactions, r.emoji);
+  } else {
+    Vue.set(m.reactions, r.emoji, r.count);
+  }
+});
+
+fetch('/api/settings')
+  .then(r => r.json().then(settings => {
+    state.settings = settings;
+  }));
+
+fetch('/api/presence')
+  .then(r => r.json().then(p => {
+    state.presence = p;
+  }));
+
+let presenceEvents = new EventSource('/api/events?stream=presence');
+presenceEvents.addEventListener('typing', e => {
+  let t = JSON.parse(e.data);
+
+  if (!state.typing[t.room]) {
+    Vue.set(state.typing, t.room, {});
+  }
+  Vue.set(state.typing[t.room], t.uuid, Date.now());
+  setTimeout(() => {
+    if (Date.now() - state.typing[t.room][t.uuid] >= 5000) {
+      Vue.delete(state.typing[t.room], t.uuid);
+    }
+  }, 5000);
+});
+
+function loadRooms() {
   fetch('/api/rooms').then(r => r.json().then(rooms => {
     state.rooms = rooms;
   }));
+}
+
+function getRoom(name) {
+  if (!state.rooms[name]) {
+    Vue.set(state.rooms, name, { joined: false, members: [], metadata: null });
+  }
+  return state.rooms[name];
+}
+
+function updateMember(e) {
+  let ev = JSON.parse(e.data);
+
+  let room = getRoom(ev.room);
+  room.members = room.members.filter(m => m.UUID !== ev.member.UUID);
+  room.members.push(ev.member);
+}
+
+let roomEvents = new EventSource('/api/events?stream=rooms');
+// events may have been missed while (re)connecting
+roomEvents.addEventListener('open', loadRooms);
+roomEvents.addEventListener('room-appeared', e => {
+  getRoom(JSON.parse(e.data).room);
+});
+roomEvents.addEventListener('room-vanished', e => {
+  let ev = JSON.parse(e.data);
+
+  if (state.rooms[ev.room] && !state.rooms[ev.room].joined) {
+    Vue.delete(state.rooms, ev.room);
+  }
+});
+roomEvents.addEventListener('member-joined', updateMember);
+roomEvents.addEventListener('member-updated', updateMember);
+roomEvents.addEventListener('member-left', e => {
+  let ev = JSON.parse(e.data);
+
+  if (state.rooms[ev.room]) {
+    state.rooms[ev.room].members = state.rooms[ev.room].members.filter(m => m.UUID !== ev.member.UUID);
+  }
+});
+roomEvents.addEventListener('metadata', e => {
+  let ev = JSON.parse(e.data);
+
+  getRoom(ev.room).metadata = ev;
+});
+
+setInterval(() => {
+  fetch('/api/unread').then(r => r.json().then(unread => {
+    state.unread = unread;
+  }));
 }, 3000);
 
 const router = new VueRouter({
@@ -3,5 +3,9 @@ var state = {
   uuid: '',
   fingerprint: '',
   messages: {},
-  rooms: {}
+  rooms: {},
+  unread: {},
+  settings: {},
+  typing: {},
+  presence: { status: 'online', text: '' }
 };
@@ -15,6 +15,8 @@ Vue.component('MessagesView', {
         <ul class="list-unstyled">
           <li v-for="r in Object.keys(shared.rooms)">
             <a @click="joinRoom(r)">{{ r }}</a>
+            <small v-if="shared.rooms[r].metadata && shared.rooms[r].metadata.topic">{{ shared.rooms[r].metadata.topic }}</small>
+            <span v-if="shared.unread[r]" class="badge badge-primary">{{ shared.unread[r].count }}</span>
           </li>
           <li>
             <a @click="addRoom()">Add room</a>
@@ -23,12 +25,26 @@ Vue.component('MessagesView', {
       </nav>
 
       <div id="content">
+        <p v-if="replyTo">Replying to {{ replyTo.sender.username }} <a @click="replyTo = null">(cancel)</a></p>
         <input type="text" class="form-control" placeholder="Message" v-model="message" @keyup="send">
+        <small v-if="shared.typing[room] && Object.keys(shared.typing[room]).length">
+          {{ Object.keys(shared.typing[room]).join(', ') }} typing...
+        </small>
 
         <ul class="list-unstyled">
           <li v-for="m in shared.messages[room]" :key="m.id">
             <h4>{{ m.sender.username }} ({{ m.sender.uuid }})</h4>
-            <p>{{ m.content }}</p>
+            <p v-if="m.deleted"><em>Message deleted</em></p>
+            <p v-else>{{ m.content }} <small v-if="m.edited">(edited)</small></p>
+            <div>
+              <span v-for="(count, emoji) in m.reactions">{{ emoji }} {{ count }} </span>
+              <a @click="react(m)">React</a>
+              <a @click="replyTo = m">Reply</a>
+            </div>
+            <div v-if="m.sender.uuid == shared.uuid && !m.deleted">
+              <a @click="editMessage(m)">Edit</a>
+              <a @click="deleteMessage(m)">Delete</a>
+            </div>
           </li>
         </ul>
       </div>
@@ -38,29 +54,79 @@ Vue.component('MessagesView', {
     return {
       room: '',
       message: '',
+      replyTo: null,
       shared: state,
     };
   },
   methods: {
     send: async function(e) {
       if (e.keyCode != 13) {
+        fetch(`/api/rooms/${encodeURIComponent(this.room)}/typing`, {
+          method: 'POST',
+        });
         return;
       }
 
-      await fetch(`/api/rooms/${this.room}/messages`, {
+      await fetch(`/api/rooms/${encodeURIComponent(this.room)}/message`, {
         method: 'POST',
         body: JSON.stringify({
           username: this.shared.username,
           content: this.message,
+          reply_to: this.replyTo ? this.replyTo.id : undefined,
         }),
       });
       this.message = '';
+      this.replyTo = null;
+      await this.markRead();
+    },
+    react: async function(m) {
+      const emoji = prompt('Reaction');
+      if (!emoji) {
+        return;
+      }
+
+      await fetch(`/api/rooms/${encodeURIComponent(m.room)}/messages/${m.id}/reactions/${encodeURIComponent(emoji)}`, {
+        method: 'PUT',
+      });
+    },
+    editMessage: async function(m) {
+      const content = prompt('New message', m.content);
+      if (!content) {
+        return;
+      }
+
+      await fetch(`/api/rooms/${encodeURIComponent(m.room)}/messages/${m.id}`, {
+        method: 'PUT',
+        body: JSON.stringify({ content }),
+      });
+    },
+    deleteMessage: async function(m) {
+      await fetch(`/api/rooms/${encodeURIComponent(m.room)}/messages/${m.id}`, {
+        method: 'DELETE',
+      });
     },
     joinRoom: async function(name) {
-      await fetch(`/api/rooms/${name}`, {
+      await fetch(`/api/rooms/${encodeURIComponent(name)}`, {
         method: 'POST',
       });
       this.room = name;
+      this.shared.rooms[name].joined = true;
+
+      const history = await fetch(`/api/rooms/${encodeURIComponent(name)}/messages`).then(r => r.json());
+      Vue.set(this.shared.messages, name, history);
+      await this.markRead();
+    },
+    markRead: async function() {
+      const messages = this.shared.messages[this.room] || [];
+      if (!messages.length) {
+        return;
+      }
+
+      await fetch(`/api/rooms/${encodeURIComponent(this.room)}/read`, {
+        method: 'PUT',
+        body: JSON.stringify({ message: messages[messages.length - 1].id }),
+      });
+      Vue.delete(this.shared.unread, this.room);
     },
     addRoom: async function() {
       const name = prompt('Name of new room');
@@ -68,8 +134,8 @@ Vue.component('MessagesView', {
         return
       }
 
-      await fetch(`/api/rooms/${this.room}`, {
-        method: 'POST',
+      await fetch(`/api/rooms/${encodeURIComponent(name)}`, {
+        method: 'PUT',
       });
     },
   }
@@ -85,6 +151,32 @@ Vue.component('SettingsView', {
 
       <h2>Username</h2>
       <input type="text" class="form-control" placeholder="Username" v-model="shared.username">
+
+      <h2>Status</h2>
+      <select class="form-control" v-model="shared.presence.status" @change="setPresence">
+        <option value="online">Online</option>
+        <option value="away">Away</option>
+        <option value="dnd">Do not disturb</option>
+      </select>
+      <input type="text" class="form-control" placeholder="Status message" v-model="shared.presence.text"
+        @change="setPresence">
+
+      <h2>Privacy</h2>
+      <div class="form-check">
+        <input type="checkbox" class="form-check-input" id="readReceipts" v-model="shared.settings.read_receipts"
+          @change="saveSettings">
+        <label class="form-check-label" for="readReceipts">Send read receipts</label>
+      </div>
+      <div class="form-check">
+        <input type="checkbox" class="form-check-input" id="relay" v-model="shared.settings.relay"
+          @change="saveSettings">
+        <label class="form-check-label" for="relay">Relay messages for members who can't reach each other</label>
+      </div>
+      <div class="form-check">
+        <input type="checkbox" class="form-check-input" id="shareHistory" v-model="shared.settings.share_history"
+          @change="saveSettings">
+        <label class="form-check-label" for="shareHistory">Share room history with verified members</label>
+      </div>
     </div>
   `,
   data() {
@@ -92,5 +184,19 @@ Vue.component('SettingsView', {
       shared: state,
       message: '',
     };
+  },
+  methods: {
+    setPresence: async function() {
+      await fetch('/api/presence', {
+        method: 'PUT',
+        body: JSON.stringify(this.shared.presence),
+      });
+    },
+    saveSettings: async function() {
+      await fetch('/api/settings', {
+        method: 'PUT',
+        body: JSON.stringify(this.shared.settings),
+      });
+    },
   }
 });
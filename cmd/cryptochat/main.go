@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bufio"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 
 	"github.com/devplayer0/cryptochat/pkg/server"
 	log "github.com/sirupsen/logrus"
@@ -15,9 +18,53 @@ var (
 	dbPath   = flag.String("db", "data.db", "path to sqlite database file")
 	addr     = flag.String("addr", ":0", "api listen address")
 	uiAddr   = flag.String("uiaddr", "127.0.0.1:9080", "ui listen address")
+	expiry   = flag.Int("expiry", server.DefaultDiscoveryExpiry, "missed discovery intervals before forgetting a peer")
+	peerFile = flag.String("peers", "", "path to file listing static peer addresses (host:port), one per line")
+
+	rendezvousServer = flag.Bool("rendezvous-server", false, "act as a rendezvous node for peers on other subnets")
+
+	quic     = flag.Bool("quic", false, "also accept and make peer api requests over quic")
+	quicLoss = flag.Float64("quic-loss", 0, "proportion of outgoing quic packets to drop (to test lossy links)")
 )
 
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// readPeerFile reads a list of peer addresses, ignoring blank lines and comments
+func readPeerFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open peers file: %w", err)
+	}
+	defer f.Close()
+
+	peers := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		peers = append(peers, line)
+	}
+
+	return peers, scanner.Err()
+}
+
 func main() {
+	var peers stringList
+	var rendezvous stringList
+	flag.Var(&peers, "peer", "static peer address (host:port), may be repeated")
+	flag.Var(&rendezvous, "rendezvous", "rendezvous node address (host:port), may be repeated")
 	flag.Parse()
 
 	level, err := log.ParseLevel(*logLevel)
@@ -26,7 +73,26 @@ func main() {
 	}
 	log.SetLevel(level)
 
-	srv, err := server.NewServer(*dbPath)
+	if *peerFile != "" {
+		filePeers, err := readPeerFile(*peerFile)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to read static peers")
+		}
+
+		peers = append(peers, filePeers...)
+	}
+
+	srv, err := server.NewServer(server.Config{
+		DBPath:          *dbPath,
+		DiscoveryExpiry: *expiry,
+		StaticPeers:     peers,
+
+		RendezvousNodes:  rendezvous,
+		RendezvousServer: *rendezvousServer,
+
+		QUIC:     *quic,
+		QUICLoss: *quicLoss,
+	})
 	if err != nil {
 		log.WithError(err).Fatal("Failed to start server")
 	}
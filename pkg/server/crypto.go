@@ -1,9 +1,11 @@
 package server
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
@@ -96,6 +98,22 @@ func GetCertFingerprint(cert *x509.Certificate) string {
 	return hex.EncodeToString(sum[:])
 }
 
+// sign signs data with this user's private key
+func (s *Server) sign(data []byte) ([]byte, error) {
+	hash := sha256.Sum256(data)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.cert.PrivateKey.(*rsa.PrivateKey), crypto.SHA256, hash[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign data: %w", err)
+	}
+
+	return sig, nil
+}
+
+// checkSignature verifies that data was signed by the owner of a certificate
+func checkSignature(cert *x509.Certificate, data, sig []byte) error {
+	return cert.CheckSignature(x509.SHA256WithRSA, data, sig)
+}
+
 type verificationInfo struct {
 	UUID        string `json:"uuid"`
 	Fingerprint string `json:"fingerprint"`
@@ -12,15 +12,81 @@ import (
 )
 
 const sqlCreateSchema string = `
-CREATE TABLE kv(key TEXT NOT NULL PRIMARY KEY, value BLOB);
-CREATE TABLE users(uuid BLOB(16) NOT NULL PRIMARY KEY, cert BLOB NOT NULL, verified BOOL);
+CREATE TABLE IF NOT EXISTS kv(key TEXT NOT NULL PRIMARY KEY, value BLOB);
+CREATE TABLE IF NOT EXISTS users(uuid BLOB(16) NOT NULL PRIMARY KEY, cert BLOB NOT NULL, verified BOOL);
+CREATE TABLE IF NOT EXISTS messages(
+	id BLOB(16) NOT NULL PRIMARY KEY,
+	room TEXT NOT NULL,
+	sender BLOB(16) NOT NULL,
+	username TEXT NOT NULL,
+	content TEXT NOT NULL,
+	sent TIMESTAMP NOT NULL,
+	edited TIMESTAMP,
+	deleted BOOL NOT NULL DEFAULT false,
+	reply_to BLOB(16),
+	thread BLOB(16),
+	expires TIMESTAMP,
+	signature BLOB,
+	clock INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS messages_room ON messages(room);
+CREATE INDEX IF NOT EXISTS messages_order ON messages(room, clock, sender, id);
+CREATE INDEX IF NOT EXISTS messages_thread ON messages(thread);
+CREATE INDEX IF NOT EXISTS messages_expires ON messages(expires) WHERE expires IS NOT NULL;
+CREATE TABLE IF NOT EXISTS message_edits(
+	message BLOB(16) NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+	content TEXT NOT NULL,
+	time TIMESTAMP NOT NULL
+);
+CREATE TABLE IF NOT EXISTS reactions(
+	message BLOB(16) NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+	user BLOB(16) NOT NULL,
+	emoji TEXT NOT NULL,
+	PRIMARY KEY(message, user, emoji)
+);
+CREATE TABLE IF NOT EXISTS read_markers(
+	room TEXT NOT NULL PRIMARY KEY,
+	message BLOB(16) NOT NULL,
+	clock INTEGER NOT NULL,
+	sender BLOB(16) NOT NULL
+);
+CREATE TABLE IF NOT EXISTS read_receipts(
+	room TEXT NOT NULL,
+	user BLOB(16) NOT NULL,
+	message BLOB(16) NOT NULL,
+	clock INTEGER NOT NULL,
+	sender BLOB(16) NOT NULL,
+	PRIMARY KEY(room, user)
+);
+CREATE TABLE IF NOT EXISTS room_settings(
+	room TEXT NOT NULL PRIMARY KEY,
+	ttl INTEGER NOT NULL DEFAULT 0,
+	muted BOOLEAN NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS joined_rooms(room TEXT NOT NULL PRIMARY KEY, joined TIMESTAMP NOT NULL);
+CREATE TABLE IF NOT EXISTS static_peers(address TEXT NOT NULL PRIMARY KEY);
+CREATE TABLE IF NOT EXISTS room_secrets(room TEXT NOT NULL PRIMARY KEY, secret BLOB NOT NULL);
+CREATE TABLE IF NOT EXISTS room_manifests(room TEXT NOT NULL PRIMARY KEY, manifest BLOB NOT NULL, signature BLOB NOT NULL);
+CREATE TABLE IF NOT EXISTS room_metadata(room TEXT NOT NULL PRIMARY KEY, metadata BLOB NOT NULL, signature BLOB NOT NULL);
+CREATE TABLE IF NOT EXISTS room_creators(room TEXT NOT NULL PRIMARY KEY, creator BLOB(16) NOT NULL);
 `
 
-func (s *Server) dbInit() error {
+const sqlMessageColumns = "id, room, sender, username, content, sent, edited, deleted, reply_to, thread, expires, " +
+	"signature, clock"
+
+// sqlMessageOrder orders messages causally (by Lamport clock), breaking ties by sender and then ID so that all members
+// see the same order
+const sqlMessageOrder = "clock, sender, id"
+
+func (s *Server) dbCreateTables() error {
 	if _, err := s.db.Exec(sqlCreateSchema); err != nil {
 		return fmt.Errorf("failed to create tables: %w", err)
 	}
 
+	return nil
+}
+
+func (s *Server) dbInit() error {
 	log.Infof("Generating %v bit RSA key and certificate", rsaBits)
 	cert, err := GenerateCert(rsaBits, uuid.New().String(), certValidity)
 	if err != nil {
@@ -76,7 +142,30 @@ func (s *Server) loadCert() (tls.Certificate, error) {
 }
 
 type sqlStmts struct {
+	getKV, setKV *sql.Stmt
+
 	addUser, retrieveUser, setUserVerified *sql.Stmt
+
+	addMessage, retrieveMessage, roomHistory, editMessage, deleteMessage *sql.Stmt
+	addMessageEdit, retrieveMessageEdits, clearMessageEdits              *sql.Stmt
+	threadMessages, sharedHistory, latestMessage, roomClock              *sql.Stmt
+
+	addReaction, removeReaction, roomReactions, messageReactions *sql.Stmt
+
+	setReadMarker, unreadCounts, setReadReceipt, messageReadReceipts *sql.Stmt
+
+	expiredMessages, deleteExpiredMessages *sql.Stmt
+	getRoomSettings, setRoomSettings       *sql.Stmt
+
+	addStaticPeer, removeStaticPeer, staticPeers *sql.Stmt
+
+	getRoomSecret, setRoomSecret, removeRoomSecret, roomSecrets *sql.Stmt
+
+	getRoomManifest, setRoomManifest *sql.Stmt
+	getRoomMetadata, setRoomMetadata *sql.Stmt
+	getRoomCreator, setRoomCreator   *sql.Stmt
+
+	addJoinedRoom, removeJoinedRoom, joinedRooms *sql.Stmt
 }
 
 func prepareSQLStatements(db *sql.DB) (sqlStmts, error) {
@@ -85,6 +174,16 @@ func prepareSQLStatements(db *sql.DB) (sqlStmts, error) {
 		err error
 	)
 
+	s.getKV, err = db.Prepare("SELECT value FROM kv WHERE key = ?")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare setting retrieval statement: %w", err)
+	}
+
+	s.setKV, err = db.Prepare("INSERT OR REPLACE INTO kv(key, value) VALUES(?, ?)")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare setting update statement: %w", err)
+	}
+
 	s.addUser, err = db.Prepare("INSERT INTO users(uuid, cert, verified) VALUES(?, ?, false)")
 	if err != nil {
 		return s, fmt.Errorf("failed to prepare user creation statement: %w", err)
@@ -100,9 +199,257 @@ func prepareSQLStatements(db *sql.DB) (sqlStmts, error) {
 		return s, fmt.Errorf("failed to prepare user verification statement: %w", err)
 	}
 
+	s.addMessage, err = db.Prepare(`INSERT INTO messages(id, room, sender, username, content, sent, reply_to, thread,
+		expires, signature, clock) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare message creation statement: %w", err)
+	}
+
+	s.retrieveMessage, err = db.Prepare("SELECT " + sqlMessageColumns + " FROM messages WHERE id = ?")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare message retrieval statement: %w", err)
+	}
+
+	s.roomHistory, err = db.Prepare("SELECT " + sqlMessageColumns + " FROM messages WHERE room = ? ORDER BY " +
+		sqlMessageOrder)
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare room history statement: %w", err)
+	}
+
+	// only unmodified messages can be shared, since signatures cover the original content
+	s.sharedHistory, err = db.Prepare("SELECT " + sqlMessageColumns + ` FROM messages
+		WHERE room = ? AND sent > ? AND (clock, sender, id) > (?, ?, ?)
+		AND signature IS NOT NULL AND edited IS NULL AND NOT deleted
+		ORDER BY clock DESC, sender DESC, id DESC LIMIT ?`)
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare shared history statement: %w", err)
+	}
+
+	s.roomClock, err = db.Prepare("SELECT COALESCE(MAX(clock), 0) FROM messages WHERE room = ?")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare room clock statement: %w", err)
+	}
+
+	s.latestMessage, err = db.Prepare("SELECT sent FROM messages WHERE room = ? ORDER BY sent DESC LIMIT 1")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare latest message statement: %w", err)
+	}
+
+	s.editMessage, err = db.Prepare("UPDATE messages SET content = ?, edited = ? WHERE id = ?")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare message edit statement: %w", err)
+	}
+
+	s.deleteMessage, err = db.Prepare("UPDATE messages SET content = '', edited = ?, deleted = true WHERE id = ?")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare message deletion statement: %w", err)
+	}
+
+	s.addMessageEdit, err = db.Prepare("INSERT INTO message_edits(message, content, time) VALUES(?, ?, ?)")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare message edit trail statement: %w", err)
+	}
+
+	s.retrieveMessageEdits, err = db.Prepare("SELECT content, time FROM message_edits WHERE message = ? ORDER BY time")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare message edit trail retrieval statement: %w", err)
+	}
+
+	s.clearMessageEdits, err = db.Prepare("DELETE FROM message_edits WHERE message = ?")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare message edit trail deletion statement: %w", err)
+	}
+
+	s.threadMessages, err = db.Prepare("SELECT " + sqlMessageColumns + " FROM messages WHERE thread = ? ORDER BY " +
+		sqlMessageOrder)
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare thread retrieval statement: %w", err)
+	}
+
+	s.addReaction, err = db.Prepare("INSERT OR IGNORE INTO reactions(message, user, emoji) VALUES(?, ?, ?)")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare reaction creation statement: %w", err)
+	}
+
+	s.removeReaction, err = db.Prepare("DELETE FROM reactions WHERE message = ? AND user = ? AND emoji = ?")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare reaction removal statement: %w", err)
+	}
+
+	s.roomReactions, err = db.Prepare(`SELECT reactions.message, reactions.emoji, COUNT(*) FROM reactions
+		JOIN messages ON messages.id = reactions.message WHERE messages.room = ?
+		GROUP BY reactions.message, reactions.emoji`)
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare room reactions statement: %w", err)
+	}
+
+	s.messageReactions, err = db.Prepare("SELECT message, emoji, COUNT(*) FROM reactions WHERE message = ? GROUP BY emoji")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare message reactions statement: %w", err)
+	}
+
+	// read markers and receipts store the position of the message (in sqlMessageOrder) they were set at
+	s.setReadMarker, err = db.Prepare(`INSERT OR REPLACE INTO read_markers(room, message, clock, sender)
+		VALUES(?, ?, ?, ?)`)
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare read marker update statement: %w", err)
+	}
+
+	// the unread messages in each room are numbered in order to pick out the first one
+	s.unreadCounts, err = db.Prepare(`SELECT room, id, unread FROM (
+		SELECT messages.room, messages.id, COUNT(*) OVER (PARTITION BY messages.room) AS unread,
+			ROW_NUMBER() OVER (PARTITION BY messages.room ORDER BY messages.clock, messages.sender, messages.id) AS n
+		FROM messages
+		LEFT JOIN read_markers ON read_markers.room = messages.room
+		LEFT JOIN room_settings ON room_settings.room = messages.room
+		WHERE messages.sender != ? AND NOT messages.deleted AND NOT COALESCE(room_settings.muted, 0)
+			AND (read_markers.room IS NULL OR (messages.clock, messages.sender, messages.id) >
+				(read_markers.clock, read_markers.sender, read_markers.message))
+	) WHERE n = 1`)
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare unread count statement: %w", err)
+	}
+
+	s.setReadReceipt, err = db.Prepare(`INSERT INTO read_receipts(room, user, message, clock, sender)
+		VALUES(?, ?, ?, ?, ?) ON CONFLICT(room, user)
+		DO UPDATE SET message = excluded.message, clock = excluded.clock, sender = excluded.sender
+		WHERE (excluded.clock, excluded.sender, excluded.message) >
+			(read_receipts.clock, read_receipts.sender, read_receipts.message)`)
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare read receipt update statement: %w", err)
+	}
+
+	s.messageReadReceipts, err = db.Prepare(`SELECT read_receipts.user FROM read_receipts
+		JOIN messages ON messages.room = read_receipts.room WHERE messages.id = ?
+			AND (read_receipts.clock, read_receipts.sender, read_receipts.message) >=
+				(messages.clock, messages.sender, messages.id)`)
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare read receipt retrieval statement: %w", err)
+	}
+
+	s.expiredMessages, err = db.Prepare("SELECT id, room FROM messages WHERE expires <= ?")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare expired message retrieval statement: %w", err)
+	}
+
+	s.deleteExpiredMessages, err = db.Prepare("DELETE FROM messages WHERE expires <= ?")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare expired message deletion statement: %w", err)
+	}
+
+	s.getRoomSettings, err = db.Prepare("SELECT ttl, muted FROM room_settings WHERE room = ?")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare room settings retrieval statement: %w", err)
+	}
+
+	s.setRoomSettings, err = db.Prepare("INSERT OR REPLACE INTO room_settings(room, ttl, muted) VALUES(?, ?, ?)")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare room settings update statement: %w", err)
+	}
+
+	s.addStaticPeer, err = db.Prepare("INSERT OR IGNORE INTO static_peers(address) VALUES(?)")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare static peer creation statement: %w", err)
+	}
+
+	s.removeStaticPeer, err = db.Prepare("DELETE FROM static_peers WHERE address = ?")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare static peer removal statement: %w", err)
+	}
+
+	s.staticPeers, err = db.Prepare("SELECT address FROM static_peers ORDER BY address")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare static peer retrieval statement: %w", err)
+	}
+
+	s.getRoomSecret, err = db.Prepare("SELECT secret FROM room_secrets WHERE room = ?")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare room secret retrieval statement: %w", err)
+	}
+
+	s.setRoomSecret, err = db.Prepare("INSERT OR REPLACE INTO room_secrets(room, secret) VALUES(?, ?)")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare room secret update statement: %w", err)
+	}
+
+	s.removeRoomSecret, err = db.Prepare("DELETE FROM room_secrets WHERE room = ?")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare room secret removal statement: %w", err)
+	}
+
+	s.roomSecrets, err = db.Prepare("SELECT room, secret FROM room_secrets")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare room secrets retrieval statement: %w", err)
+	}
+
+	s.getRoomManifest, err = db.Prepare("SELECT manifest, signature FROM room_manifests WHERE room = ?")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare room manifest retrieval statement: %w", err)
+	}
+
+	s.setRoomManifest, err = db.Prepare("INSERT OR REPLACE INTO room_manifests(room, manifest, signature) VALUES(?, ?, ?)")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare room manifest update statement: %w", err)
+	}
+
+	s.getRoomMetadata, err = db.Prepare("SELECT metadata, signature FROM room_metadata WHERE room = ?")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare room metadata retrieval statement: %w", err)
+	}
+
+	s.setRoomMetadata, err = db.Prepare("INSERT OR REPLACE INTO room_metadata(room, metadata, signature) VALUES(?, ?, ?)")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare room metadata update statement: %w", err)
+	}
+
+	s.getRoomCreator, err = db.Prepare("SELECT creator FROM room_creators WHERE room = ?")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare room creator retrieval statement: %w", err)
+	}
+
+	// a room's creator never changes once known
+	s.setRoomCreator, err = db.Prepare("INSERT OR IGNORE INTO room_creators(room, creator) VALUES(?, ?)")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare room creator insert statement: %w", err)
+	}
+
+	// keep the original join time if already joined
+	s.addJoinedRoom, err = db.Prepare("INSERT OR IGNORE INTO joined_rooms(room, joined) VALUES(?, ?)")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare joined room insert statement: %w", err)
+	}
+
+	s.removeJoinedRoom, err = db.Prepare("DELETE FROM joined_rooms WHERE room = ?")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare joined room removal statement: %w", err)
+	}
+
+	s.joinedRooms, err = db.Prepare("SELECT room, joined FROM joined_rooms ORDER BY joined")
+	if err != nil {
+		return s, fmt.Errorf("failed to prepare joined rooms retrieval statement: %w", err)
+	}
+
 	return s, nil
 }
 
+// getSetting retrieves a value from the key-value store, returning nil if the key does not exist
+func (s *Server) getSetting(key string) ([]byte, error) {
+	var value []byte
+	if err := s.stmts.getKV.QueryRow(key).Scan(&value); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to retrieve setting %v from database: %w", key, err)
+	}
+
+	return value, nil
+}
+
+func (s *Server) setSetting(key string, value []byte) error {
+	if _, err := s.stmts.setKV.Exec(key, value); err != nil {
+		return fmt.Errorf("failed to update setting %v in database: %w", key, err)
+	}
+
+	return nil
+}
+
 // User represents an API user
 type User struct {
 	UUID     uuid.UUID
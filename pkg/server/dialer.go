@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// dialStagger is the delay between starting connection attempts to each of a peer's addresses (RFC 8305)
+const dialStagger = 250 * time.Millisecond
+
+// peerDialer connects to peers by UUID, trying each of their advertised addresses
+type peerDialer struct {
+	discovery Discovery
+	dialer    net.Dialer
+
+	preferredLock sync.Mutex
+	preferred     map[uuid.UUID]string
+}
+
+func newPeerDialer(discovery Discovery) *peerDialer {
+	return &peerDialer{
+		discovery: discovery,
+		preferred: make(map[uuid.UUID]string),
+	}
+}
+
+// peerURL builds a URL for a request to a peer, to be resolved by peerDialer
+func peerURL(id uuid.UUID, path string) string {
+	return fmt.Sprintf("https://%v%v", id, path)
+}
+
+// linkLocalZones returns the interfaces over which an IPv6 link-local address could be reached
+func linkLocalZones() []string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.WithError(err).Warn("Failed to list network interfaces")
+		return nil
+	}
+
+	zones := []string{}
+	for _, i := range ifaces {
+		if i.Flags&net.FlagUp == 0 || i.Flags&net.FlagMulticast == 0 || i.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		zones = append(zones, i.Name)
+	}
+	return zones
+}
+
+// peerAddrs returns the addresses of a peer on a port, interleaving address families (starting with IPv6). Link-local
+// addresses are reached through the interface `zone`, or every interface if it isn't known.
+func peerAddrs(ips []net.IP, zone string, port int) []string {
+	p := strconv.Itoa(port)
+
+	var v4, v6 []string
+	for _, ip := range ips {
+		switch {
+		case ip.To4() != nil:
+			v4 = append(v4, net.JoinHostPort(ip.String(), p))
+		case ip.IsLinkLocalUnicast():
+			zones := []string{zone}
+			if zone == "" {
+				// link-local addresses are meaningless without a zone, try all of them
+				zones = linkLocalZones()
+			}
+			for _, z := range zones {
+				v6 = append(v6, net.JoinHostPort(ip.String()+"%"+z, p))
+			}
+		default:
+			v6 = append(v6, net.JoinHostPort(ip.String(), p))
+		}
+	}
+
+	addrs := make([]string, 0, len(v4)+len(v6))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			addrs = append(addrs, v6[i])
+		}
+		if i < len(v4) {
+			addrs = append(addrs, v4[i])
+		}
+	}
+	return addrs
+}
+
+// candidates returns the addresses to try for a peer, in the order they should be attempted
+func (p *peerDialer) candidates(m RoomMember) []string {
+	addrs := peerAddrs(m.Addrs, m.Zone, m.Port)
+
+	p.preferredLock.Lock()
+	preferred, ok := p.preferred[m.UUID]
+	p.preferredLock.Unlock()
+	if ok {
+		for i, a := range addrs {
+			if a == preferred {
+				copy(addrs[1:i+1], addrs[:i])
+				addrs[0] = preferred
+				break
+			}
+		}
+	}
+
+	return addrs
+}
+
+// DialContext connects to the peer whose UUID is the host part of `addr` (or directly to `addr` if it is not a UUID)
+func (p *peerDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	id, err := uuid.Parse(host)
+	if err != nil {
+		// not a peer UUID, probably a static peer's address
+		return p.dialer.DialContext(ctx, network, addr)
+	}
+
+	m, ok := p.discovery.Lookup(id)
+	if !ok {
+		return nil, fmt.Errorf("peer %v not found", id)
+	}
+
+	addrs := p.candidates(m)
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses known for peer %v", id)
+	}
+
+	conn, used, err := p.race(ctx, network, addrs)
+	if err != nil {
+		p.preferredLock.Lock()
+		delete(p.preferred, id)
+		p.preferredLock.Unlock()
+		return nil, err
+	}
+
+	p.preferredLock.Lock()
+	p.preferred[id] = used
+	p.preferredLock.Unlock()
+	return conn, nil
+}
+
+// verifyDialedPeer checks that a peer dialed by UUID presented a certificate for that UUID (anyone can advertise
+// addresses for a peer, so whoever answers at them has to prove they are the peer)
+func verifyDialedPeer(cs tls.ConnectionState) error {
+	id, err := uuid.Parse(cs.ServerName)
+	if err != nil {
+		// not dialed by UUID
+		return nil
+	}
+
+	if cn := cs.PeerCertificates[0].Subject.CommonName; cn != id.String() {
+		return fmt.Errorf("peer presented certificate for %v", cn)
+	}
+	return nil
+}
+
+type dialResult struct {
+	conn net.Conn
+	addr string
+	err  error
+}
+
+// race makes staggered connection attempts to each address, returning the first to succeed
+func (p *peerDialer) race(ctx context.Context, network string, addrs []string) (net.Conn, string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(addrs))
+	var (
+		started, failed int
+		lastErr         error
+	)
+	next := time.After(0)
+	for {
+		select {
+		case <-next:
+			addr := addrs[started]
+			go func() {
+				conn, err := p.dialer.DialContext(ctx, network, addr)
+				results <- dialResult{conn, addr, err}
+			}()
+
+			started++
+			next = nil
+			if started < len(addrs) {
+				next = time.After(dialStagger)
+			}
+		case r := <-results:
+			if r.err == nil {
+				closeDials(results, started-failed-1)
+				return r.conn, r.addr, nil
+			}
+
+			failed++
+			lastErr = r.err
+			if failed == len(addrs) {
+				return nil, "", lastErr
+			}
+			if started < len(addrs) {
+				// don't wait to try the next address
+				next = time.After(0)
+			}
+		case <-ctx.Done():
+			closeDials(results, started-failed)
+			return nil, "", ctx.Err()
+		}
+	}
+}
+
+// closeDials closes any connections made by `pending` outstanding attempts which lost the race
+func closeDials(results <-chan dialResult, pending int) {
+	go func() {
+		for ; pending > 0; pending-- {
+			if r := <-results; r.err == nil {
+				r.conn.Close()
+			}
+		}
+	}()
+}
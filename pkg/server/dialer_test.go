@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestCandidates(t *testing.T) {
+	p := newPeerDialer(nil)
+	m := RoomMember{
+		UUID:  uuid.New(),
+		Addrs: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("2001:db8::1")},
+		Port:  1234,
+	}
+
+	expected := []string{"[2001:db8::1]:1234", "192.0.2.1:1234", "192.0.2.2:1234"}
+	if addrs := p.candidates(m); !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("expected address families to be interleaved as %v, got %v", expected, addrs)
+	}
+
+	// the address which worked last time is tried first
+	p.preferred[m.UUID] = "192.0.2.2:1234"
+	expected = []string{"192.0.2.2:1234", "[2001:db8::1]:1234", "192.0.2.1:1234"}
+	if addrs := p.candidates(m); !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("expected preferred address to be first in %v, got %v", expected, addrs)
+	}
+}
+
+func TestRace(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// nothing is listening on the port of a listener which has been closed
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	p := newPeerDialer(nil)
+	conn, used, err := p.race(context.Background(), "tcp", []string{closed.Addr().String(), l.Addr().String()})
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	conn.Close()
+	if used != l.Addr().String() {
+		t.Errorf("expected to connect to %v, got %v", l.Addr(), used)
+	}
+}
+
+func TestVerifyDialedPeer(t *testing.T) {
+	s := newTestServer(t, NewMemoryRegistry())
+	certs := []*x509.Certificate{s.cert.Leaf}
+
+	for _, c := range []struct {
+		serverName string
+		valid      bool
+	}{
+		{s.id.String(), true},
+		{uuid.New().String(), false},
+		{"127.0.0.1", true},
+	} {
+		err := verifyDialedPeer(tls.ConnectionState{ServerName: c.serverName, PeerCertificates: certs})
+		if (err == nil) != c.valid {
+			t.Errorf("dialed %v: expected valid to be %v, got error %v", c.serverName, c.valid, err)
+		}
+	}
+}
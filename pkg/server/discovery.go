@@ -1,209 +1,405 @@
 package server
 
 import (
-	"context"
-	"fmt"
+	"crypto/sha256"
+	"encoding/hex"
 	"net"
-	"regexp"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/grandcat/zeroconf"
 	log "github.com/sirupsen/logrus"
 )
 
-const domain = "local."
-const srvName = "_cryptochat._tcp"
-const interval = 3 * time.Second
-const browseTime = 500 * time.Millisecond
-
-var roomRegex = regexp.MustCompile(`^room=(.+)$`)
+// Discovery finds peers and the rooms they are in, advertising this user's rooms and presence in return
+type Discovery interface {
+	// Start runs discovery (advertising the peer API on TCP port `apiPort`, and on UDP port `quicPort` over QUIC if
+	// it isn't 0) until Close is called
+	Start(apiPort, quicPort int) error
+	// Close stops discovery, informing peers that this user has gone offline
+	Close() error
+
+	// SetPresence updates the presence advertised for this user
+	SetPresence(p Presence)
+	// GetPresence retrieves the presence advertised for this user
+	GetPresence() Presence
+
+	// AddRoom adds a room to the list of rooms this user is in
+	AddRoom(room string) bool
+	// RemoveRoom removes a room from the list of rooms this user is in
+	RemoveRoom(room string) bool
+	// IsMember checks if this user is a member of a room
+	IsMember(room string) bool
+	// SetRoomSecret makes a room private, advertising it by a tag derived from `secret` (or public if nil)
+	SetRoomSecret(room string, secret []byte)
+	// Membership retrieves the list of rooms this user is in
+	Membership() []string
+
+	// GetRooms retrieves a map of rooms and their members
+	GetRooms() map[string][]RoomMember
+	// Lookup finds a peer which is a member of any room
+	Lookup(id uuid.UUID) (RoomMember, bool)
+	// Subscribe returns a channel of changes to discovered peers and rooms and a function to cancel the subscription
+	Subscribe() (<-chan DiscoveryEvent, func())
+}
 
 // RoomMember represents a member of a room
 type RoomMember struct {
-	UUID uuid.UUID
-	Addr net.TCPAddr
+	UUID     uuid.UUID
+	Addrs    []net.IP
+	Port     int
+	Presence Presence
+	LastSeen time.Time
+
+	// Version is the peer API protocol version advertised by the member (0 if not advertised)
+	Version int
+	// QUICPort is the UDP port the member accepts QUIC connections on (0 if it doesn't)
+	QUICPort int
+	// Zone is the network interface the member's IPv6 link-local addresses are reachable through (if known)
+	Zone string
+}
+
+// sameAs checks if the advertised information about a member has changed
+func (m RoomMember) sameAs(o RoomMember) bool {
+	if m.UUID != o.UUID || m.Port != o.Port || m.Presence != o.Presence || m.Version != o.Version ||
+		m.QUICPort != o.QUICPort || m.Zone != o.Zone || len(m.Addrs) != len(o.Addrs) {
+		return false
+	}
+
+	for i := range m.Addrs {
+		if !m.Addrs[i].Equal(o.Addrs[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// roomAdvert is the set of rooms a user advertises, public rooms by name and private rooms by tag
+type roomAdvert struct {
+	Rooms   []string
+	Private []string
 }
 
-// Discovery represents a CryptoChat discovery server / client
-type Discovery struct {
-	id uuid.UUID
+// hash computes a short digest of an advertisement which changes whenever the set of rooms does
+func (a roomAdvert) hash() string {
+	rooms := append([]string{}, a.Rooms...)
+	private := append([]string{}, a.Private...)
+	sort.Strings(rooms)
+	sort.Strings(private)
+
+	h := sha256.New()
+	for _, r := range rooms {
+		h.Write([]byte("room=" + r + "\n"))
+	}
+	for _, tag := range private {
+		h.Write([]byte("proom=" + tag + "\n"))
+	}
+
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
 
-	roomsLock  sync.RWMutex
+// peerAdvert is the last advertisement received from a peer
+type peerAdvert struct {
+	member RoomMember
+	rooms  roomAdvert
+}
+
+// peerTable keeps track of this user's rooms and presence along with the rooms discovered peers are in, publishing
+// events as they change (the parts of Discovery common to all backends)
+type peerTable struct {
+	lock       sync.RWMutex
 	rooms      map[string][]RoomMember
 	membership []string
+	presence   Presence
+
+	// secrets maps private rooms to their secret and tags maps the advertised tag of each private room to its name
+	secrets map[string][]byte
+	tags    map[string]string
 
-	server *zeroconf.Server
-	quit   chan struct{}
+	// adverts are kept so that they can be re-read when room secrets change
+	adverts      map[uuid.UUID]peerAdvert
+	peerPresence map[uuid.UUID]Presence
+	events       *eventBus
 }
 
-// NewDiscovery creates a new discovery server / client
-func NewDiscovery(id uuid.UUID) Discovery {
-	return Discovery{
-		id:         id,
+func newPeerTable() peerTable {
+	return peerTable{
 		rooms:      make(map[string][]RoomMember),
 		membership: []string{},
+		presence:   Presence{Status: StatusOnline},
+
+		secrets: make(map[string][]byte),
+		tags:    make(map[string]string),
+
+		adverts:      make(map[uuid.UUID]peerAdvert),
+		peerPresence: make(map[uuid.UUID]Presence),
+		events:       newEventBus(),
 	}
 }
 
-func (d *Discovery) addEntry(e *zeroconf.ServiceEntry) {
-	id, err := uuid.Parse(e.Instance)
-	if err != nil {
-		log.WithField("uuid", e.Instance).Debug("Failed to parse discovered UUID")
-		return
-	}
+// resolveRooms determines which rooms an advertisement refers to (must be called with the lock held)
+func (t *peerTable) resolveRooms(a roomAdvert) map[string]bool {
+	advertised := make(map[string]bool)
+	for _, r := range a.Rooms {
+		if !validRoomName(r) {
+			continue
+		}
 
-	if id == d.id {
-		return
+		// a public room with the same name as a private room is a different room
+		if _, private := t.secrets[r]; !private {
+			advertised[r] = true
+		}
 	}
-
-	member := RoomMember{
-		UUID: id,
-		Addr: net.TCPAddr{
-			IP:   e.AddrIPv4[0],
-			Port: e.Port,
-		},
+	for _, tag := range a.Private {
+		if r, ok := t.tags[tag]; ok {
+			advertised[r] = true
+		}
 	}
 
-	for _, r := range e.Text {
-		m := roomRegex.FindStringSubmatch(r)
-		if len(m) == 0 {
-			continue
-		}
+	return advertised
+}
 
-		room := m[1]
+// updateMember records the rooms a peer currently advertises
+func (t *peerTable) updateMember(member RoomMember, a roomAdvert) {
+	t.lock.Lock()
+	t.adverts[member.UUID] = peerAdvert{member, a}
+	events := t.applyAdvert(member, a)
+	t.lock.Unlock()
+
+	t.events.publish(events...)
+}
 
-		d.roomsLock.Lock()
-		if _, ok := d.rooms[room]; !ok {
-			d.rooms[room] = []RoomMember{}
+// applyAdvert updates the rooms a peer is in, returning the resulting events (must be called with the lock held)
+func (t *peerTable) applyAdvert(member RoomMember, a roomAdvert) []DiscoveryEvent {
+	advertised := t.resolveRooms(a)
+
+	var events []DiscoveryEvent
+	if old, seen := t.peerPresence[member.UUID]; !seen || old != member.Presence {
+		events = append(events, DiscoveryEvent{Type: EventPresenceChanged, Member: member})
+	}
+	t.peerPresence[member.UUID] = member.Presence
+
+	// the peer may have left rooms since we last saw it
+	events = append(events, t.removeFromRooms(member.UUID, advertised)...)
+
+	for room := range advertised {
+		members, ok := t.rooms[room]
+		if !ok {
+			events = append(events, DiscoveryEvent{Type: EventRoomAppeared, Room: room})
 		}
 
-		members := d.rooms[room]
 		found := false
 		for i, m := range members {
 			if m.UUID == member.UUID {
+				if !m.sameAs(member) {
+					events = append(events, DiscoveryEvent{Type: EventMemberUpdated, Room: room, Member: member})
+				}
+
 				members[i] = member
 				found = true
 				break
 			}
 		}
 		if !found {
-			d.rooms[room] = append(d.rooms[room], member)
+			t.rooms[room] = append(members, member)
+			events = append(events, DiscoveryEvent{Type: EventMemberJoined, Room: room, Member: member})
 		}
-		d.roomsLock.Unlock()
 	}
+
+	return events
 }
 
-// Start starts discovery server and client
-func (d *Discovery) Start(apiPort int) error {
-	var err error
+// setRoomSecret updates the secret for a room and re-reads the rooms peers advertise
+func (t *peerTable) setRoomSecret(room string, secret []byte) {
+	t.lock.Lock()
+	if old, ok := t.secrets[room]; ok {
+		delete(t.tags, roomTag(room, old))
+		delete(t.secrets, room)
+	}
+	if secret != nil {
+		t.secrets[room] = secret
+		t.tags[roomTag(room, secret)] = room
+	}
 
-	d.server, err = zeroconf.Register(d.id.String(), srvName, domain, apiPort, []string{}, nil)
-	if err != nil {
-		return fmt.Errorf("failed to create DNS-SD server: %w", err)
+	var events []DiscoveryEvent
+	for _, a := range t.adverts {
+		events = append(events, t.applyAdvert(a.member, a.rooms)...)
 	}
+	t.lock.Unlock()
 
-	t := time.NewTicker(interval)
+	t.events.publish(events...)
+}
+
+// removeMember forgets about a peer which has gone offline
+func (t *peerTable) removeMember(id uuid.UUID) {
+	t.lock.Lock()
+	events := t.removeFromRooms(id, nil)
+	delete(t.adverts, id)
+	delete(t.peerPresence, id)
+	t.lock.Unlock()
+
+	t.events.publish(events...)
+}
 
-	for {
-		select {
-		case <-t.C:
-			resolver, err := zeroconf.NewResolver()
-			if err != nil {
-				return fmt.Errorf("failed to create DNS-SD resolver: %w", err)
+// removeFromRooms removes a peer from all rooms except those in `keep`, returning the resulting events (must be called
+// with the lock held)
+func (t *peerTable) removeFromRooms(id uuid.UUID, keep map[string]bool) []DiscoveryEvent {
+	var events []DiscoveryEvent
+	for room, members := range t.rooms {
+		if keep[room] {
+			continue
+		}
+
+		for i, m := range members {
+			if m.UUID == id {
+				members = append(members[:i], members[i+1:]...)
+				events = append(events, DiscoveryEvent{Type: EventMemberLeft, Room: room, Member: m})
+				break
 			}
+		}
 
-			entries := make(chan *zeroconf.ServiceEntry)
-			go func() {
-				for e := range entries {
-					d.addEntry(e)
-				}
-			}()
+		if len(members) == 0 {
+			delete(t.rooms, room)
+			events = append(events, DiscoveryEvent{Type: EventRoomVanished, Room: room})
+		} else {
+			t.rooms[room] = members
+		}
+	}
 
-			ctx, cancel := context.WithTimeout(context.Background(), browseTime)
-			if err := resolver.Browse(ctx, srvName, domain, entries); err != nil {
-				cancel()
-				return fmt.Errorf("failed to start browsing for DNS-SD services: %w", err)
+	return events
+}
+
+// expireMembers removes peers which have not been seen since `before`
+func (t *peerTable) expireMembers(before time.Time) {
+	t.lock.Lock()
+	var events []DiscoveryEvent
+	for room, members := range t.rooms {
+		alive := members[:0]
+		for _, m := range members {
+			if m.LastSeen.Before(before) {
+				log.WithFields(log.Fields{
+					"uuid": m.UUID,
+					"room": room,
+				}).Debug("Room member expired")
+				events = append(events, DiscoveryEvent{Type: EventMemberLeft, Room: room, Member: m})
+				continue
 			}
 
-			<-ctx.Done()
-			cancel()
-		case <-d.quit:
-			t.Stop()
-			return nil
+			alive = append(alive, m)
+		}
+
+		if len(alive) == 0 {
+			delete(t.rooms, room)
+			events = append(events, DiscoveryEvent{Type: EventRoomVanished, Room: room})
+		} else {
+			t.rooms[room] = alive
+		}
+	}
+	for id, a := range t.adverts {
+		if a.member.LastSeen.Before(before) {
+			delete(t.adverts, id)
+			delete(t.peerPresence, id)
+		}
+	}
+	t.lock.Unlock()
+
+	t.events.publish(events...)
+}
+
+// advertisement retrieves the rooms and presence which should be advertised for this user
+func (t *peerTable) advertisement() (roomAdvert, Presence) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	a := roomAdvert{Rooms: []string{}, Private: []string{}}
+	for _, r := range t.membership {
+		if secret, ok := t.secrets[r]; ok {
+			a.Private = append(a.Private, roomTag(r, secret))
+		} else {
+			a.Rooms = append(a.Rooms, r)
 		}
 	}
+
+	return a, t.presence
 }
 
-// Close shuts down the discover server / client
-func (d *Discovery) Close() error {
-	close(d.quit)
-	d.server.Shutdown()
+func (t *peerTable) setPresence(p Presence) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 
-	return nil
+	t.presence = p
 }
 
-func (d *Discovery) updateTXTs() {
-	d.roomsLock.RLock()
-	defer d.roomsLock.RUnlock()
+// GetPresence retrieves the presence advertised for this user
+func (t *peerTable) GetPresence() Presence {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
 
-	txts := make([]string, len(d.membership))
-	for i, r := range d.membership {
-		txts[i] = "room=" + r
-	}
-	d.server.SetText(txts)
+	return t.presence
 }
 
-// AddRoom adds a room to the list of rooms this user is in
-func (d *Discovery) AddRoom(room string) bool {
-	d.roomsLock.Lock()
+func (t *peerTable) addRoom(room string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 
-	for _, r := range d.membership {
+	for _, r := range t.membership {
 		if r == room {
-			d.roomsLock.Unlock()
 			return false
 		}
 	}
 
-	d.membership = append(d.membership, room)
-	d.roomsLock.Unlock()
-
-	d.updateTXTs()
+	t.membership = append(t.membership, room)
 	return true
 }
 
-// RemoveRoom removes a room from the list of rooms this user is in
-func (d *Discovery) RemoveRoom(room string) bool {
-	d.roomsLock.Lock()
+func (t *peerTable) removeRoom(room string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 
-	for i, r := range d.membership {
+	for i, r := range t.membership {
 		if r == room {
-			e := len(d.membership) - 1
-			d.membership[e], d.membership[i] = d.membership[i], d.membership[e]
-			d.membership = d.membership[:e]
-			d.roomsLock.Unlock()
+			e := len(t.membership) - 1
+			t.membership[e], t.membership[i] = t.membership[i], t.membership[e]
+			t.membership = t.membership[:e]
+			return true
+		}
+	}
 
-			d.updateTXTs()
+	return false
+}
+
+// IsMember checks if this user is a member of a room
+func (t *peerTable) IsMember(room string) bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	for _, r := range t.membership {
+		if r == room {
 			return true
 		}
 	}
 
-	d.roomsLock.Unlock()
 	return false
 }
 
+// Membership retrieves the list of rooms this user is in
+func (t *peerTable) Membership() []string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return append([]string{}, t.membership...)
+}
+
 // GetRooms retrieves a map of rooms and their members
-func (d *Discovery) GetRooms() map[string][]RoomMember {
-	d.roomsLock.RLock()
-	defer d.roomsLock.RUnlock()
+func (t *peerTable) GetRooms() map[string][]RoomMember {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
 
 	rooms := make(map[string][]RoomMember)
-	for r, ms := range d.rooms {
+	for r, ms := range t.rooms {
 		members := make([]RoomMember, len(ms))
-		for i, m := range ms {
-			members[i] = m
-		}
+		copy(members, ms)
 
 		rooms[r] = members
 	}
@@ -211,16 +407,199 @@ func (d *Discovery) GetRooms() map[string][]RoomMember {
 	return rooms
 }
 
-// IsMember checks if this user is a member of a room
-func (d *Discovery) IsMember(room string) bool {
-	d.roomsLock.RLock()
-	defer d.roomsLock.RUnlock()
+// Lookup finds a peer which is a member of any room
+func (t *peerTable) Lookup(id uuid.UUID) (RoomMember, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
 
-	for _, r := range d.membership {
-		if r == room {
-			return true
+	for _, members := range t.rooms {
+		for _, m := range members {
+			if m.UUID == id {
+				return m, true
+			}
 		}
 	}
 
-	return false
+	return RoomMember{}, false
+}
+
+// Subscribe returns a channel of changes to discovered peers and rooms and a function to cancel the subscription
+func (t *peerTable) Subscribe() (<-chan DiscoveryEvent, func()) {
+	return t.events.Subscribe()
+}
+
+// multiDiscovery combines several discovery backends, advertising through all of them and merging their results (this
+// user's own rooms and presence are taken from the first)
+type multiDiscovery []Discovery
+
+func (m multiDiscovery) Start(apiPort, quicPort int) error {
+	errCh := make(chan error, len(m))
+	for _, d := range m {
+		go func(d Discovery) {
+			errCh <- d.Start(apiPort, quicPort)
+		}(d)
+	}
+
+	for range m {
+		if err := <-errCh; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m multiDiscovery) Close() error {
+	var err error
+	for _, d := range m {
+		if e := d.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+func (m multiDiscovery) SetPresence(p Presence) {
+	for _, d := range m {
+		d.SetPresence(p)
+	}
+}
+
+func (m multiDiscovery) GetPresence() Presence {
+	return m[0].GetPresence()
+}
+
+func (m multiDiscovery) AddRoom(room string) bool {
+	added := false
+	for _, d := range m {
+		if d.AddRoom(room) {
+			added = true
+		}
+	}
+
+	return added
+}
+
+func (m multiDiscovery) RemoveRoom(room string) bool {
+	removed := false
+	for _, d := range m {
+		if d.RemoveRoom(room) {
+			removed = true
+		}
+	}
+
+	return removed
+}
+
+func (m multiDiscovery) SetRoomSecret(room string, secret []byte) {
+	for _, d := range m {
+		d.SetRoomSecret(room, secret)
+	}
+}
+
+func (m multiDiscovery) IsMember(room string) bool {
+	return m[0].IsMember(room)
+}
+
+func (m multiDiscovery) Membership() []string {
+	return m[0].Membership()
+}
+
+// mergeMember adds a member to a list, replacing an existing entry for the same peer if it is more recent
+func mergeMember(members []RoomMember, member RoomMember) []RoomMember {
+	for i, m := range members {
+		if m.UUID == member.UUID {
+			if member.LastSeen.After(m.LastSeen) {
+				members[i] = member
+			}
+			return members
+		}
+	}
+
+	return append(members, member)
+}
+
+func (m multiDiscovery) GetRooms() map[string][]RoomMember {
+	rooms := make(map[string][]RoomMember)
+	for _, d := range m {
+		for room, members := range d.GetRooms() {
+			for _, member := range members {
+				rooms[room] = mergeMember(rooms[room], member)
+			}
+		}
+	}
+
+	return rooms
+}
+
+func (m multiDiscovery) Lookup(id uuid.UUID) (RoomMember, bool) {
+	var (
+		found  RoomMember
+		exists bool
+	)
+	for _, d := range m {
+		if member, ok := d.Lookup(id); ok && (!exists || member.LastSeen.After(found.LastSeen)) {
+			found = member
+			exists = true
+		}
+	}
+
+	return found, exists
+}
+
+// visible checks if an event from one backend changes the merged view (e.g. a member leaving a room in one backend is
+// hidden if another backend still has them in the room)
+func (m multiDiscovery) visible(from int, e DiscoveryEvent) bool {
+	for i, d := range m {
+		if i == from {
+			continue
+		}
+
+		members, ok := d.GetRooms()[e.Room]
+		switch e.Type {
+		case EventRoomAppeared, EventRoomVanished:
+			if ok {
+				return false
+			}
+		case EventMemberJoined, EventMemberLeft:
+			for _, member := range members {
+				if member.UUID == e.Member.UUID {
+					return false
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+func (m multiDiscovery) Subscribe() (<-chan DiscoveryEvent, func()) {
+	out := make(chan DiscoveryEvent, eventBufferSize)
+	cancels := make([]func(), 0, len(m))
+
+	var wg sync.WaitGroup
+	for i, d := range m {
+		ch, cancel := d.Subscribe()
+		cancels = append(cancels, cancel)
+
+		wg.Add(1)
+		go func(from int) {
+			defer wg.Done()
+			for e := range ch {
+				if m.visible(from, e) {
+					out <- e
+				}
+			}
+		}(i)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out, func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}
 }
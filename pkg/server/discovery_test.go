@@ -0,0 +1,30 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestMultiDiscoveryVisible(t *testing.T) {
+	a, b := newStaticDiscovery(), newStaticDiscovery()
+	m := multiDiscovery{a, b}
+
+	member := RoomMember{UUID: uuid.New(), Presence: Presence{Status: StatusOnline}}
+	a.updateMember(member, roomAdvert{Rooms: []string{"both", "a"}})
+	b.updateMember(member, roomAdvert{Rooms: []string{"both"}})
+
+	for _, c := range []struct {
+		event   DiscoveryEvent
+		visible bool
+	}{
+		{DiscoveryEvent{Type: EventMemberLeft, Room: "both", Member: member}, false},
+		{DiscoveryEvent{Type: EventMemberLeft, Room: "a", Member: member}, true},
+		{DiscoveryEvent{Type: EventRoomVanished, Room: "both"}, false},
+		{DiscoveryEvent{Type: EventRoomAppeared, Room: "a"}, true},
+	} {
+		if v := m.visible(0, c.event); v != c.visible {
+			t.Errorf("%v in room %v: expected visible to be %v", c.event.Type, c.event.Room, c.visible)
+		}
+	}
+}
@@ -2,11 +2,16 @@ package server
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 )
@@ -70,14 +75,19 @@ func JSONReq(c *http.Client, method, url string, b interface{}, r interface{}) e
 	}
 	defer res.Body.Close()
 
-	d := json.NewDecoder(res.Body)
-	if res.StatusCode >= 400 {
+	return decodeJSONResponse(res.StatusCode, res.Body, r)
+}
+
+// decodeJSONResponse decodes a JSON response body into `r` (if not nil), returning an error if `status` is an error
+func decodeJSONResponse(status int, body io.Reader, r interface{}) error {
+	d := json.NewDecoder(body)
+	if status >= 400 {
 		var e jsonError
 		if err := d.Decode(&e); err != nil {
 			return fmt.Errorf("failed to unmarshal error response: %w", err)
 		}
 
-		return fmt.Errorf("server responded with HTTP %v %v", res.StatusCode, e.Message)
+		return fmt.Errorf("server responded with HTTP %v %v", status, e.Message)
 	}
 
 	if r == nil {
@@ -89,9 +99,259 @@ func JSONReq(c *http.Client, method, url string, b interface{}, r interface{}) e
 	return nil
 }
 
+func (s *Server) apiInfo(w http.ResponseWriter, r *http.Request) {
+	rooms, presence := s.static.advertisement()
+	JSONResponse(w, apiPeerInfo{
+		UUID:         s.id.String(),
+		Version:      protocolVersion,
+		QUICPort:     s.quicPort(),
+		Rooms:        rooms.Rooms,
+		PrivateRooms: rooms.Private,
+		Presence:     presence,
+	}, http.StatusOK)
+}
+
+// apiRendezvousRegister adds, renews or removes the requester's registration (when acting as a rendezvous node)
+func (s *Server) apiRendezvousRegister(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value(keyUser).(User)
+
+	if r.Method == http.MethodDelete {
+		s.rendezvous.unregister(u.UUID)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var p apiRendezvousPeer
+	if err := ParseJSONBody(&p, w, r); err != nil {
+		return
+	}
+	if p.Port <= 0 || p.Port > 65535 {
+		JSONErrResponse(w, fmt.Errorf("invalid port %v", p.Port), http.StatusBadRequest)
+		return
+	}
+
+	// the requester can only register itself, and the address it connected from is likely the most reachable one
+	p.UUID = u.UUID.String()
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			p.Addrs = append([]net.IP{ip}, p.Addrs...)
+		}
+	}
+
+	s.rendezvous.register(u.UUID, p)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiRendezvousPeers lists the nodes registered with this one (when acting as a rendezvous node)
+func (s *Server) apiRendezvousPeers(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value(keyUser).(User)
+
+	JSONResponse(w, s.rendezvous.peers(u.UUID), http.StatusOK)
+}
+
+type apiReqChallenge struct {
+	Nonce []byte `json:"nonce"`
+}
+
+type apiResChallenge struct {
+	// Nonce is the challenge for the requester to prove its own membership with
+	Nonce []byte `json:"nonce"`
+	Proof []byte `json:"proof"`
+}
+
+// apiChallenge proves this user's membership of a protected room and challenges the requester to do the same
+func (s *Server) apiChallenge(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value(keyUser).(User)
+
+	var b apiReqChallenge
+	if err := ParseJSONBody(&b, w, r); err != nil {
+		return
+	}
+	if len(b.Nonce) != nonceSize {
+		JSONErrResponse(w, fmt.Errorf("nonce must be %v bytes", nonceSize), http.StatusBadRequest)
+		return
+	}
+
+	room := mux.Vars(r)["room"]
+	if !s.discovery.IsMember(room) {
+		JSONErrResponse(w, errors.New("user is not a member of this room"), http.StatusBadRequest)
+		return
+	}
+	secret, err := s.getRoomSecret(room)
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+	if secret == nil {
+		JSONErrResponse(w, errors.New("room is not protected"), http.StatusBadRequest)
+		return
+	}
+
+	nonce, err := s.auth.challenge(u.UUID, room)
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+	JSONResponse(w, apiResChallenge{
+		Nonce: nonce,
+		Proof: roomProof(secret, room, s.id, u.UUID, b.Nonce),
+	}, http.StatusOK)
+}
+
+type apiReqProve struct {
+	Proof []byte `json:"proof"`
+}
+
+// apiProve checks the requester's response to a challenge
+func (s *Server) apiProve(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value(keyUser).(User)
+
+	var b apiReqProve
+	if err := ParseJSONBody(&b, w, r); err != nil {
+		return
+	}
+
+	room := mux.Vars(r)["room"]
+	secret, err := s.getRoomSecret(room)
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+	if secret == nil || !s.auth.answerChallenge(u.UUID, room, func(nonce []byte) bool {
+		return hmac.Equal(b.Proof, roomProof(secret, room, u.UUID, s.id, nonce))
+	}) {
+		JSONErrResponse(w, errors.New("incorrect proof of room membership"), http.StatusForbidden)
+		return
+	}
+
+	s.auth.prove(u.UUID, room)
+	w.WriteHeader(http.StatusNoContent)
+}
+
 type apiReqSendMessage struct {
-	Username string `json:"username"`
-	Content  string `json:"content"`
+	ID       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	Username string    `json:"username"`
+	Content  string    `json:"content"`
+
+	ReplyTo string `json:"reply_to,omitempty"`
+	Thread  string `json:"thread,omitempty"`
+	TTL     int    `json:"ttl,omitempty"`
+
+	// Signature is the sender's signature of the message, allowing it to be passed on to other members
+	Signature []byte `json:"signature,omitempty"`
+	// Clock is the sender's Lamport clock for the room, used to order messages causally
+	Clock int64 `json:"clock,omitempty"`
+}
+
+// forPeer strips the signature and clock from messages sent to peers which don't understand them
+func (b apiReqSendMessage) forPeer(caps apiResCapabilities) (interface{}, bool) {
+	if !caps.has(capSignedMessages) {
+		b.Signature = nil
+		b.Clock = 0
+	}
+
+	return b, true
+}
+
+// newAPIReqSendMessage converts a message into the form sent to peers
+func newAPIReqSendMessage(m Message) apiReqSendMessage {
+	b := apiReqSendMessage{
+		ID:        m.ID.String(),
+		Time:      m.Sent,
+		Username:  m.Username,
+		Content:   m.Content,
+		Signature: m.Signature,
+		Clock:     m.Clock,
+	}
+	if m.ReplyTo != uuid.Nil {
+		b.ReplyTo = m.ReplyTo.String()
+	}
+	if m.Thread != uuid.Nil {
+		b.Thread = m.Thread.String()
+	}
+	if m.Expires.Valid {
+		b.TTL = int(m.Expires.Time.Sub(m.Sent) / time.Second)
+	}
+
+	return b
+}
+
+// parseOptionalUUID parses a UUID, returning uuid.Nil for an empty string
+func parseOptionalUUID(s string) (uuid.UUID, error) {
+	if s == "" {
+		return uuid.Nil, nil
+	}
+
+	return uuid.Parse(s)
+}
+
+// maxClockSkew is how far a received message's clock can be ahead of the room's clock as seen by this user. It is far
+// more than the number of messages a member could miss, while stopping clocks from being pushed towards overflowing.
+const maxClockSkew = 1 << 32
+
+// messageFromRequest builds a message sent to a room by `sender`
+func (s *Server) messageFromRequest(room string, sender uuid.UUID, b apiReqSendMessage) (Message, error) {
+	id, err := uuid.Parse(b.ID)
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to parse message ID: %w", err)
+	}
+
+	m := Message{
+		ID:       id,
+		Room:     room,
+		Sender:   sender,
+		Username: b.Username,
+		Content:  b.Content,
+		Sent:     b.Time,
+
+		Signature: b.Signature,
+		Clock:     b.Clock,
+	}
+	if m.Clock < 0 {
+		return m, errors.New("message clock must not be negative")
+	}
+	clock, err := s.roomClock(room)
+	if err != nil {
+		return m, err
+	}
+	if m.Clock > clock+maxClockSkew {
+		return m, fmt.Errorf("message clock is too far ahead of the room's (%v)", clock)
+	}
+	if m.ReplyTo, err = parseOptionalUUID(b.ReplyTo); err != nil {
+		return m, fmt.Errorf("failed to parse reply message ID: %w", err)
+	}
+	if m.Thread, err = parseOptionalUUID(b.Thread); err != nil {
+		return m, fmt.Errorf("failed to parse thread ID: %w", err)
+	}
+
+	m.setTTL(b.TTL)
+	return m, nil
+}
+
+// receiveMessage stores a message received from a peer, ignoring it if it has expired or was already received (e.g.
+// both directly and via a relay)
+func (s *Server) receiveMessage(m Message) error {
+	if m.expired() {
+		return nil
+	}
+
+	if _, err := s.getMessage(m.ID); err == nil {
+		return nil
+	} else if !errors.Is(err, errMessageNotFound) {
+		return err
+	}
+
+	if err := s.addMessage(m); err != nil {
+		if errors.Is(err, errDuplicateMessage) {
+			// the same message arrived another way (e.g. via a relay) since it was checked for
+			return nil
+		}
+		return err
+	}
+
+	s.publishJSON(streamMessages, newUIEventMessage(m))
+	return nil
 }
 
 func (s *Server) apiSendMessage(w http.ResponseWriter, r *http.Request) {
@@ -104,17 +364,393 @@ func (s *Server) apiSendMessage(w http.ResponseWriter, r *http.Request) {
 
 	vars := mux.Vars(r)
 	room := vars["room"]
-	if !s.discovery.IsMember(room) {
-		JSONErrResponse(w, errors.New("user is not a member of this room"), http.StatusBadRequest)
+	if !s.roomAccess(w, room, u) {
+		return
+	}
+
+	m, err := s.messageFromRequest(room, u.UUID, b)
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusBadRequest)
+		return
+	}
+	if m.Signature != nil {
+		if err := s.checkMessageSignature(m); err != nil {
+			JSONErrResponse(w, err, http.StatusForbidden)
+			return
+		}
+	}
+
+	if err := s.receiveMessage(m); err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiRelay accepts a message relayed by another member, delivering it locally if this user is one of its targets and
+// passing it on to the other targets (if relaying is enabled)
+func (s *Server) apiRelay(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value(keyUser).(User)
+
+	var b apiReqRelay
+	if err := ParseJSONBody(&b, w, r); err != nil {
+		return
+	}
+
+	room := mux.Vars(r)["room"]
+	if !s.roomAccess(w, room, u) {
+		return
+	}
+	if !u.Verified {
+		JSONErrResponse(w, errors.New("only verified users can relay messages"), http.StatusForbidden)
+		return
+	}
+	if b.Hops < 0 || b.Hops > maxRelayHops {
+		JSONErrResponse(w, fmt.Errorf("hop count must be between 0 and %v", maxRelayHops), http.StatusBadRequest)
+		return
+	}
+
+	var sm apiSignedMessage
+	if err := s.openPayload(b.Message, &sm, func() uuid.UUID { return sm.Sender }); err != nil {
+		JSONErrResponse(w, fmt.Errorf("rejected relayed message: %w", err), http.StatusForbidden)
+		return
+	}
+	if sm.Room != room {
+		JSONErrResponse(w, errors.New("message is for a different room"), http.StatusBadRequest)
+		return
+	}
+
+	banned, err := s.isBanned(room, sm.Sender)
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+	if banned {
+		JSONErrResponse(w, errors.New("sender is banned from this room"), http.StatusForbidden)
+		return
+	}
+
+	m, err := s.messageFromRequest(room, sm.Sender, sm.apiReqSendMessage)
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusBadRequest)
+		return
+	}
+	if m.Signature != nil {
+		if err := s.checkMessageSignature(m); err != nil {
+			JSONErrResponse(w, err, http.StatusForbidden)
+			return
+		}
+	}
+
+	if containsUUID(b.Targets, s.id) {
+		if err := s.receiveMessage(m); err != nil {
+			JSONErrResponse(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if b.Hops > 0 && s.relays.markSeen(m.ID) {
+		settings, err := s.loadSettings()
+		if err != nil {
+			JSONErrResponse(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		if settings.Relay {
+			go s.relayOnward(room, b)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type apiReqEditMessage struct {
+	Time    time.Time `json:"time"`
+	Content string    `json:"content,omitempty"`
+}
+
+// roomMessage looks up the message referenced by a request, ensuring it belongs to the room in the request
+func (s *Server) roomMessage(w http.ResponseWriter, r *http.Request) (Message, bool) {
+	vars := mux.Vars(r)
+	return s.findRoomMessage(w, vars["id"], vars["room"])
+}
+
+// findRoomMessage looks up a message by its ID, ensuring it belongs to `room`
+func (s *Server) findRoomMessage(w http.ResponseWriter, idStr, room string) (Message, bool) {
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		JSONErrResponse(w, fmt.Errorf("failed to parse message ID: %w", err), http.StatusBadRequest)
+		return Message{}, false
+	}
+
+	m, err := s.getMessage(id)
+	if errors.Is(err, errMessageNotFound) || (err == nil && m.Room != room) {
+		JSONErrResponse(w, errMessageNotFound, http.StatusNotFound)
+		return m, false
+	}
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return m, false
+	}
+
+	return m, true
+}
+
+// authoredMessage looks up the message referenced by a request, ensuring it was sent by `author` to the room in the
+// request
+func (s *Server) authoredMessage(w http.ResponseWriter, r *http.Request, author uuid.UUID) (Message, bool) {
+	m, ok := s.roomMessage(w, r)
+	if !ok {
+		return m, false
+	}
+
+	if m.Sender != author {
+		JSONErrResponse(w, errors.New("message was not sent by this user"), http.StatusForbidden)
+		return m, false
+	}
+
+	return m, true
+}
+
+// applyMessageEdit edits or deletes (depending on the request method) a message and notifies the UI
+func (s *Server) applyMessageEdit(w http.ResponseWriter, r *http.Request, m *Message, b apiReqEditMessage) bool {
+	var (
+		err   error
+		event string
+	)
+	switch r.Method {
+	case http.MethodPut:
+		err = s.editMessage(m, b.Content, b.Time)
+		event = eventMessageEdit
+	case http.MethodDelete:
+		err = s.deleteMessage(m, b.Time)
+		event = eventMessageDelete
+	}
+	if errors.Is(err, errEditSuperseded) {
+		// edits can arrive out of order, the newer one has already been applied
+		return true
+	}
+	if err != nil {
+		JSONErrResponse(w, fmt.Errorf("failed to edit message: %w", err), http.StatusBadRequest)
+		return false
+	}
+
+	s.publishJSONEvent(streamMessages, event, newUIEventMessage(*m))
+	return true
+}
+
+func (s *Server) apiEditMessage(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value(keyUser).(User)
+
+	var b apiReqEditMessage
+	if err := ParseJSONBody(&b, w, r); err != nil {
+		return
+	}
+
+	if !s.roomAccess(w, mux.Vars(r)["room"], u) {
+		return
+	}
+
+	m, ok := s.authoredMessage(w, r, u.UUID)
+	if !ok {
+		return
+	}
+
+	if s.applyMessageEdit(w, r, &m, b) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// applyReaction adds or removes (depending on the request method) a user's reaction to a message and notifies the UI
+func (s *Server) applyReaction(w http.ResponseWriter, r *http.Request, m Message, user uuid.UUID) bool {
+	emoji := mux.Vars(r)["emoji"]
+	if !validReaction(emoji) {
+		JSONErrResponse(w, errors.New("invalid reaction"), http.StatusBadRequest)
+		return false
+	}
+
+	add := r.Method == http.MethodPut
+	count, err := s.setReaction(m, user, emoji, add)
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return false
+	}
+
+	s.publishJSONEvent(streamMessages, eventReaction, uiEventReaction{
+		Room:    m.Room,
+		Message: m.ID.String(),
+		User:    user.String(),
+		Emoji:   emoji,
+		Added:   add,
+		Count:   count,
+	})
+	return true
+}
+
+func (s *Server) apiReact(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value(keyUser).(User)
+
+	if !s.roomAccess(w, mux.Vars(r)["room"], u) {
+		return
+	}
+
+	m, ok := s.roomMessage(w, r)
+	if !ok {
+		return
+	}
+
+	if s.applyReaction(w, r, m, u.UUID) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) apiTyping(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value(keyUser).(User)
+
+	room := mux.Vars(r)["room"]
+	if !s.roomAccess(w, room, u) {
 		return
 	}
 
-	s.publishJSON(streamMessages, uiEventMessage{
-		Sender: uiMessageSender{
-			Username: b.Username,
-			UUID:     u.UUID.String(),
-		},
-		Room:    vars["room"],
-		Content: b.Content,
+	if s.typingReceive.allow(u.UUID.String() + "/" + room) {
+		s.publishJSONEvent(streamPresence, eventTyping, uiEventTyping{
+			UUID: u.UUID.String(),
+			Room: room,
+		})
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type apiReqReadReceipt struct {
+	Message string `json:"message"`
+}
+
+func (s *Server) apiReadReceipt(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value(keyUser).(User)
+
+	var b apiReqReadReceipt
+	if err := ParseJSONBody(&b, w, r); err != nil {
+		return
+	}
+
+	room := mux.Vars(r)["room"]
+	if !s.roomAccess(w, room, u) {
+		return
+	}
+
+	m, ok := s.findRoomMessage(w, b.Message, room)
+	if !ok {
+		return
+	}
+
+	if err := s.setReadReceipt(m, u.UUID); err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	s.publishJSONEvent(streamMessages, eventRead, uiEventRead{
+		UUID:    u.UUID.String(),
+		Room:    room,
+		Message: m.ID.String(),
 	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) apiManifest(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value(keyUser).(User)
+
+	var b signedPayload
+	if err := ParseJSONBody(&b, w, r); err != nil {
+		return
+	}
+
+	room := mux.Vars(r)["room"]
+	if !s.roomAccess(w, room, u) {
+		return
+	}
+
+	m, changed, err := s.acceptManifest(room, b)
+	if err != nil {
+		JSONErrResponse(w, fmt.Errorf("rejected room manifest: %w", err), http.StatusForbidden)
+		return
+	}
+	if changed {
+		s.publishJSONEvent(streamRooms, eventManifest, m)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) apiMetadata(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value(keyUser).(User)
+
+	var b signedPayload
+	if err := ParseJSONBody(&b, w, r); err != nil {
+		return
+	}
+
+	room := mux.Vars(r)["room"]
+	if !s.roomAccess(w, room, u) {
+		return
+	}
+
+	m, changed, err := s.acceptMetadata(room, b)
+	if err != nil {
+		JSONErrResponse(w, fmt.Errorf("rejected room metadata: %w", err), http.StatusForbidden)
+		return
+	}
+	if changed {
+		s.publishJSONEvent(streamRooms, eventMetadata, m)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type uiEventKick struct {
+	Room   string `json:"room"`
+	UUID   string `json:"uuid"`
+	Signer string `json:"by"`
+}
+
+func (s *Server) apiKick(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value(keyUser).(User)
+
+	var b signedPayload
+	if err := ParseJSONBody(&b, w, r); err != nil {
+		return
+	}
+
+	room := mux.Vars(r)["room"]
+	if !s.roomAccess(w, room, u) {
+		return
+	}
+
+	k, err := s.acceptKick(room, b)
+	if errors.Is(err, errKickSeen) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		JSONErrResponse(w, fmt.Errorf("rejected kick: %w", err), http.StatusForbidden)
+		return
+	}
+
+	if k.Target == s.id {
+		log.WithFields(log.Fields{
+			"room": room,
+			"by":   k.Signer,
+		}).Info("Kicked from room")
+		if _, err := s.leaveRoom(room); err != nil {
+			log.WithField("room", room).WithError(err).Error("Failed to leave room")
+		}
+	}
+	s.publishJSONEvent(streamRooms, eventKick, uiEventKick{
+		Room:   room,
+		UUID:   k.Target.String(),
+		Signer: k.Signer.String(),
+	})
+
+	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// eventBufferSize is how many events can be queued for a subscriber before they start being dropped
+const eventBufferSize = 64
+
+// DiscoveryEventType is the type of change described by a DiscoveryEvent
+type DiscoveryEventType string
+
+// Types of discovery event
+const (
+	EventMemberJoined    DiscoveryEventType = "member-joined"
+	EventMemberUpdated   DiscoveryEventType = "member-updated"
+	EventMemberLeft      DiscoveryEventType = "member-left"
+	EventRoomAppeared    DiscoveryEventType = "room-appeared"
+	EventRoomVanished    DiscoveryEventType = "room-vanished"
+	EventPresenceChanged DiscoveryEventType = "presence-changed"
+)
+
+// DiscoveryEvent represents a change in the discovered peers and rooms
+type DiscoveryEvent struct {
+	Type DiscoveryEventType
+	// Room is the room affected by the event (empty for EventPresenceChanged)
+	Room string
+	// Member is the peer affected by the event (zero for EventRoomAppeared and EventRoomVanished)
+	Member RoomMember
+}
+
+// subscription queues events for a subscriber, so that publishing never waits for it
+type subscription struct {
+	ch chan DiscoveryEvent
+
+	lock  sync.Mutex
+	queue []DiscoveryEvent
+	// wake is signalled when an event is queued
+	wake chan struct{}
+	done chan struct{}
+}
+
+func newSubscription() *subscription {
+	return &subscription{
+		ch: make(chan DiscoveryEvent),
+
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+}
+
+// push queues an event for the subscriber. Once eventBufferSize events are queued, further events are dropped (except
+// for EventMemberJoined, which subscribers rely on to push state to new members).
+func (s *subscription) push(e DiscoveryEvent) {
+	s.lock.Lock()
+	if len(s.queue) >= eventBufferSize && e.Type != EventMemberJoined {
+		s.lock.Unlock()
+		log.WithFields(log.Fields{
+			"type":   e.Type,
+			"room":   e.Room,
+			"member": e.Member.UUID,
+		}).Warn("Dropping discovery event for slow subscriber")
+		return
+	}
+	s.queue = append(s.queue, e)
+	s.lock.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers queued events to the subscriber until the subscription is cancelled
+func (s *subscription) run() {
+	defer close(s.ch)
+
+	for {
+		s.lock.Lock()
+		if len(s.queue) == 0 {
+			s.lock.Unlock()
+
+			select {
+			case <-s.wake:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		e := s.queue[0]
+		s.queue = s.queue[1:]
+		s.lock.Unlock()
+
+		select {
+		case s.ch <- e:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// eventBus distributes discovery events to any number of subscribers
+type eventBus struct {
+	lock        sync.RWMutex
+	subscribers map[*subscription]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subscribers: make(map[*subscription]struct{}),
+	}
+}
+
+// Subscribe returns a channel which will receive all future events and a function to cancel the subscription
+func (b *eventBus) Subscribe() (<-chan DiscoveryEvent, func()) {
+	sub := newSubscription()
+	go sub.run()
+
+	b.lock.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.lock.Unlock()
+
+	return sub.ch, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		if _, ok := b.subscribers[sub]; ok {
+			delete(b.subscribers, sub)
+			close(sub.done)
+		}
+	}
+}
+
+// publish queues events for all subscribers
+func (b *eventBus) publish(events ...DiscoveryEvent) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	for _, e := range events {
+		for sub := range b.subscribers {
+			sub.push(e)
+		}
+	}
+}
+
+// close ends all subscriptions
+func (b *eventBus) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for sub := range b.subscribers {
+		delete(b.subscribers, sub)
+		close(sub.done)
+	}
+}
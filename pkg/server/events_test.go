@@ -0,0 +1,43 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestSlowSubscriberJoins(t *testing.T) {
+	b := newEventBus()
+	defer b.close()
+	ch, cancel := b.Subscribe()
+	defer cancel()
+
+	// nothing is read until everything has been published
+	for i := 0; i < 2*eventBufferSize; i++ {
+		b.publish(DiscoveryEvent{Type: EventPresenceChanged})
+	}
+	const joins = 10
+	for i := 0; i < joins; i++ {
+		b.publish(DiscoveryEvent{Type: EventMemberJoined, Room: "test", Member: RoomMember{UUID: uuid.New()}})
+	}
+
+	var joined, other int
+	timeout := time.After(10 * time.Second)
+	for joined < joins {
+		select {
+		case e := <-ch:
+			if e.Type == EventMemberJoined {
+				joined++
+			} else {
+				other++
+			}
+		case <-timeout:
+			t.Fatalf("timed out after receiving %v join events", joined)
+		}
+	}
+	// one event might have been taken from the queue before it filled up
+	if other > eventBufferSize+1 {
+		t.Errorf("expected at most %v other events to be queued, got %v", eventBufferSize+1, other)
+	}
+}
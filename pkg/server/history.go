@@ -0,0 +1,240 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxHistoryMessages is the most messages shared in response to a single history request
+const maxHistoryMessages = 100
+
+// getSharedHistory retrieves the most recent messages in a room which can be shared with other members, in causal
+// order. Only messages sent after `since` and ordered after `after` (if not nil) are included.
+func (s *Server) getSharedHistory(room string, since time.Time, after *Message, limit int) ([]Message, error) {
+	var clock int64 = -1
+	sender, id := uuid.Nil, uuid.Nil
+	if after != nil {
+		clock, sender, id = after.Clock, after.Sender, after.ID
+	}
+
+	rows, err := s.stmts.sharedHistory.Query(room, since.UTC(), clock, sender[:], id[:], limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database for shared history: %w", err)
+	}
+
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// the query returns the newest messages first
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// latestMessageTime retrieves the time of the last message in a room (or the zero time if there are none)
+func (s *Server) latestMessageTime(room string) (time.Time, error) {
+	var t time.Time
+	if err := s.stmts.latestMessage.QueryRow(room).Scan(&t); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return t, fmt.Errorf("failed to retrieve latest message from database: %w", err)
+	}
+
+	return t, nil
+}
+
+// syncHistory requests the messages in a room since the last one this user has from a member, adding those which are
+// validly signed to the local history
+func (s *Server) syncHistory(room string, m RoomMember) error {
+	since, err := s.latestMessageTime(room)
+	if err != nil {
+		return err
+	}
+
+	q := url.Values{}
+	if !since.IsZero() {
+		q.Set("since", since.Format(time.RFC3339Nano))
+	}
+
+	var messages []apiSignedMessage
+	if err := s.requestMember(room, m, http.MethodGet,
+		fmt.Sprintf("/rooms/%v/history?%v", url.PathEscape(room), q.Encode()), nil, &messages); err != nil {
+		return fmt.Errorf("failed to request history: %w", err)
+	}
+
+	added := 0
+	for _, sm := range messages {
+		l := log.WithFields(log.Fields{
+			"room":   room,
+			"sender": sm.Sender,
+			"id":     sm.ID,
+		})
+
+		if sm.Room != room {
+			l.Warn("Ignoring shared message from a different room")
+			continue
+		}
+		if banned, err := s.isBanned(room, sm.Sender); err != nil || banned {
+			continue
+		}
+
+		msg, err := s.messageFromRequest(room, sm.Sender, sm.apiReqSendMessage)
+		if err != nil {
+			l.WithError(err).Warn("Ignoring invalid shared message")
+			continue
+		}
+		if err := s.checkMessageSignature(msg); err != nil {
+			l.WithError(err).Warn("Ignoring shared message with invalid signature")
+			continue
+		}
+
+		if err := s.receiveMessage(msg); err != nil {
+			return err
+		}
+		added++
+	}
+
+	log.WithFields(log.Fields{
+		"room":     room,
+		"id":       m.UUID,
+		"messages": added,
+	}).Debug("Synchronized room history")
+	return nil
+}
+
+// syncRoomHistory requests a room's recent history from its verified members, stopping at the first which responds
+func (s *Server) syncRoomHistory(room string) {
+	for _, m := range s.discovery.GetRooms()[room] {
+		if u, err := s.getUser(m.UUID.String()); err != nil || !u.Verified {
+			continue
+		}
+		if !s.peerCapabilities(m).has(capHistory) {
+			continue
+		}
+
+		if err := s.syncHistory(room, m); err != nil {
+			log.WithFields(log.Fields{
+				"room": room,
+				"id":   m.UUID,
+			}).WithError(err).Debug("Failed to synchronize room history")
+			continue
+		}
+		return
+	}
+}
+
+// syncHistoryOnJoin catches up on the history of rooms this user is in from verified members as they appear, until
+// `events` is closed
+func (s *Server) syncHistoryOnJoin(events <-chan DiscoveryEvent) {
+	for e := range events {
+		if e.Type != EventMemberJoined || !s.discovery.IsMember(e.Room) {
+			continue
+		}
+		if u, err := s.getUser(e.Member.UUID.String()); err != nil || !u.Verified {
+			continue
+		}
+
+		go func(e DiscoveryEvent) {
+			if !s.peerCapabilities(e.Member).has(capHistory) {
+				return
+			}
+
+			if err := s.syncHistory(e.Room, e.Member); err != nil {
+				log.WithFields(log.Fields{
+					"room": e.Room,
+					"id":   e.Member.UUID,
+				}).WithError(err).Debug("Failed to synchronize room history")
+			}
+		}(e)
+	}
+}
+
+// apiHistory shares recent messages in a room with a verified member (if enabled in the settings)
+func (s *Server) apiHistory(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value(keyUser).(User)
+
+	room := mux.Vars(r)["room"]
+	if !s.roomAccess(w, room, u) {
+		return
+	}
+	if !u.Verified {
+		JSONErrResponse(w, errors.New("history is only shared with verified users"), http.StatusForbidden)
+		return
+	}
+
+	settings, err := s.loadSettings()
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !settings.ShareHistory {
+		JSONErrResponse(w, errors.New("this user does not share room history"), http.StatusForbidden)
+		return
+	}
+
+	var since time.Time
+	var after *Message
+	q := r.URL.Query()
+	if v := q.Get("since"); v != "" {
+		if since, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			JSONErrResponse(w, fmt.Errorf("failed to parse start time: %w", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("after"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			JSONErrResponse(w, fmt.Errorf("failed to parse message ID: %w", err), http.StatusBadRequest)
+			return
+		}
+
+		m, err := s.getMessage(id)
+		if errors.Is(err, errMessageNotFound) || (err == nil && m.Room != room) {
+			JSONErrResponse(w, errMessageNotFound, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			JSONErrResponse(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		after = &m
+	}
+
+	limit := maxHistoryMessages
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			JSONErrResponse(w, errors.New("limit must be a positive integer"), http.StatusBadRequest)
+			return
+		}
+		if limit > maxHistoryMessages {
+			limit = maxHistoryMessages
+		}
+	}
+
+	messages, err := s.getSharedHistory(room, since, after, limit)
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	res := make([]apiSignedMessage, len(messages))
+	for i, m := range messages {
+		res[i] = apiSignedMessage{
+			apiReqSendMessage: newAPIReqSendMessage(m),
+			Room:              room,
+			Sender:            m.Sender,
+		}
+	}
+	JSONResponse(w, res, http.StatusOK)
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestHistorySync(t *testing.T) {
+	registry := NewMemoryRegistry()
+	a := newTestServer(t, registry)
+	b := newTestServer(t, registry)
+	trust(t, a, b)
+
+	uiRequest(t, a, http.MethodPut, "/api/settings", `{"share_history":true}`)
+	uiRequest(t, a, http.MethodPost, "/api/rooms/test", "")
+
+	// a message whose signature doesn't match shouldn't be accepted (it's older, so it's processed first)
+	forged := Message{
+		ID:        uuid.New(),
+		Room:      "test",
+		Sender:    a.id,
+		Username:  "a",
+		Content:   "forged",
+		Sent:      time.Now().Add(-time.Minute),
+		Signature: []byte("invalid"),
+	}
+	if err := a.addMessage(forged); err != nil {
+		t.Fatalf("failed to add message: %v", err)
+	}
+	for _, content := range []string{"first", "second"} {
+		uiRequest(t, a, http.MethodPost, "/api/rooms/test/message", `{"username":"a","content":"`+content+`"}`)
+	}
+
+	uiRequest(t, b, http.MethodPost, "/api/rooms/test", "")
+	eventually(t, "history to be synchronized", func() bool {
+		history, err := b.getRoomHistory("test")
+		return err == nil && len(history) == 2
+	})
+
+	history, _ := b.getRoomHistory("test")
+	for i, content := range []string{"first", "second"} {
+		if history[i].Content != content || history[i].Sender != a.id {
+			t.Errorf("expected message %v to be %q from %v, got %+v", i, content, a.id, history[i])
+		}
+	}
+}
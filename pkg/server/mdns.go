@@ -0,0 +1,672 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grandcat/zeroconf"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const domain = "local."
+const srvName = "_cryptochat._tcp"
+
+// queryInterval is how often peers are asked to announce themselves (new peers and changes to existing peers are
+// announced immediately, so this only serves to detect peers which have disappeared)
+const queryInterval = 15 * time.Second
+
+// maxInlineRoomsSize is the most space (in bytes) `room=` and `proom=` TXT strings can take up before only a hash of
+// the room list is advertised instead (keeping announcements well within a single mDNS packet)
+const maxInlineRoomsSize = 512
+
+var roomRegex = regexp.MustCompile(`^room=(.+)$`)
+var roomsHashRegex = regexp.MustCompile(`^rooms=([0-9a-f]+)$`)
+var privateRoomRegex = regexp.MustCompile(`^proom=([0-9a-f]+)$`)
+var statusRegex = regexp.MustCompile(`^status=(.+)$`)
+var statusTextRegex = regexp.MustCompile(`^statustext=(.+)$`)
+var protoRegex = regexp.MustCompile(`^proto=([0-9]+)$`)
+var quicRegex = regexp.MustCompile(`^quic=([0-9]+)$`)
+
+// MDNSDiscovery discovers peers on the local network using DNS-SD over mDNS
+type MDNSDiscovery struct {
+	peerTable
+
+	id     uuid.UUID
+	expiry int
+	// client is used to fetch the full room lists of peers which only advertise a hash
+	client *http.Client
+
+	fetchLock sync.Mutex
+	fetched   map[uuid.UUID]roomAdvert
+	fetching  map[uuid.UUID]bool
+
+	// quicPort is the UDP port QUIC connections are accepted on (0 if they aren't)
+	quicPort int
+	server   *zeroconf.Server
+	quit     chan struct{}
+}
+
+// NewMDNSDiscovery creates a new mDNS discovery server / client, forgetting about peers who have not been seen for
+// `expiry` query intervals
+func NewMDNSDiscovery(id uuid.UUID, expiry int) *MDNSDiscovery {
+	return &MDNSDiscovery{
+		peerTable: newPeerTable(),
+
+		id:     id,
+		expiry: expiry,
+
+		fetched:  make(map[uuid.UUID]roomAdvert),
+		fetching: make(map[uuid.UUID]bool),
+
+		quit: make(chan struct{}),
+	}
+}
+
+// fetchRooms retrieves the full room list of a peer which advertises only a hash of it
+func (d *MDNSDiscovery) fetchRooms(member RoomMember) {
+	d.fetchLock.Lock()
+	if d.fetching[member.UUID] {
+		d.fetchLock.Unlock()
+		return
+	}
+	d.fetching[member.UUID] = true
+	d.fetchLock.Unlock()
+
+	defer func() {
+		d.fetchLock.Lock()
+		delete(d.fetching, member.UUID)
+		d.fetchLock.Unlock()
+	}()
+
+	l := log.WithField("uuid", member.UUID)
+	if d.client == nil {
+		l.Warn("Peer advertises a room list hash but no client is available to fetch it")
+		return
+	}
+
+	var err error
+	for _, ip := range member.Addrs {
+		var (
+			info apiPeerInfo
+			id   uuid.UUID
+		)
+		info, id, err = fetchPeerInfo(d.client, net.JoinHostPort(ip.String(), strconv.Itoa(member.Port)))
+		if err != nil {
+			continue
+		}
+		if id != member.UUID {
+			err = errors.New("peer UUID does not match advertisement")
+			continue
+		}
+
+		advertised := roomAdvert{
+			Rooms:   info.Rooms,
+			Private: info.PrivateRooms,
+		}
+		d.fetchLock.Lock()
+		d.fetched[member.UUID] = advertised
+		d.fetchLock.Unlock()
+
+		d.updateMember(member, advertised)
+		return
+	}
+
+	l.WithError(err).Debug("Failed to fetch peer's room list")
+}
+
+func (d *MDNSDiscovery) addEntry(e mdnsEntry) {
+	id, err := uuid.Parse(e.Instance)
+	if err != nil {
+		log.WithField("uuid", e.Instance).Debug("Failed to parse discovered UUID")
+		return
+	}
+
+	if id == d.id {
+		return
+	}
+
+	if e.TTL == 0 {
+		// goodbye packet, the peer has gone offline
+		log.WithField("uuid", id).Debug("Peer said goodbye")
+		d.removeMember(id)
+
+		d.fetchLock.Lock()
+		delete(d.fetched, id)
+		d.fetchLock.Unlock()
+		return
+	}
+
+	member := RoomMember{
+		UUID:     id,
+		Addrs:    append(append([]net.IP{}, e.AddrIPv4...), e.AddrIPv6...),
+		Port:     e.Port,
+		Zone:     e.Zone,
+		Presence: Presence{Status: StatusOnline},
+		LastSeen: time.Now(),
+	}
+	var (
+		advertised roomAdvert
+		hash       string
+	)
+	for _, t := range e.Text {
+		t = unescapeTXT(t)
+		if m := roomRegex.FindStringSubmatch(t); len(m) != 0 {
+			advertised.Rooms = append(advertised.Rooms, m[1])
+		} else if m := roomsHashRegex.FindStringSubmatch(t); len(m) != 0 {
+			hash = m[1]
+		} else if m := privateRoomRegex.FindStringSubmatch(t); len(m) != 0 {
+			advertised.Private = append(advertised.Private, m[1])
+		} else if m := statusRegex.FindStringSubmatch(t); len(m) != 0 {
+			member.Presence.Status = PresenceStatus(m[1])
+		} else if m := statusTextRegex.FindStringSubmatch(t); len(m) != 0 {
+			member.Presence.Text = m[1]
+		} else if m := protoRegex.FindStringSubmatch(t); len(m) != 0 {
+			member.Version, _ = strconv.Atoi(m[1])
+		} else if m := quicRegex.FindStringSubmatch(t); len(m) != 0 {
+			member.QUICPort, _ = strconv.Atoi(m[1])
+		}
+	}
+	if err := member.Presence.validate(); err != nil {
+		member.Presence = Presence{Status: StatusOnline}
+	}
+
+	if hash != "" {
+		d.fetchLock.Lock()
+		fetched, ok := d.fetched[id]
+		d.fetchLock.Unlock()
+
+		if !ok || fetched.hash() != hash {
+			// use the previous list (if any) until the new one arrives
+			go d.fetchRooms(member)
+		}
+		advertised = fetched
+	}
+
+	d.updateMember(member, advertised)
+}
+
+// Start starts the discovery server and client
+func (d *MDNSDiscovery) Start(apiPort, quicPort int) error {
+	var err error
+
+	d.quicPort = quicPort
+	d.server, err = zeroconf.Register(d.id.String(), srvName, domain, apiPort, d.txts(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create DNS-SD server: %w", err)
+	}
+
+	browser, err := newMDNSBrowser(srvName, domain)
+	if err != nil {
+		return fmt.Errorf("failed to create DNS-SD browser: %w", err)
+	}
+	defer browser.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	entries := make(chan mdnsEntry)
+	go browser.Browse(ctx, entries)
+
+	if err := browser.Query(); err != nil {
+		log.WithError(err).Warn("Failed to query for DNS-SD services")
+	}
+
+	t := time.NewTicker(queryInterval)
+	defer t.Stop()
+	for {
+		select {
+		case e := <-entries:
+			d.addEntry(e)
+		case <-t.C:
+			d.expireMembers(time.Now().Add(-time.Duration(d.expiry) * queryInterval))
+
+			if err := browser.Query(); err != nil {
+				log.WithError(err).Warn("Failed to query for DNS-SD services")
+			}
+		case <-d.quit:
+			return nil
+		}
+	}
+}
+
+// Close shuts down the discovery server / client
+func (d *MDNSDiscovery) Close() error {
+	close(d.quit)
+	if d.server != nil {
+		d.server.Shutdown()
+	}
+	d.events.close()
+
+	return nil
+}
+
+func (d *MDNSDiscovery) txts() []string {
+	rooms, presence := d.advertisement()
+
+	var roomTXTs []string
+	size := 0
+	for _, r := range rooms.Rooms {
+		roomTXTs = append(roomTXTs, "room="+r)
+	}
+	for _, tag := range rooms.Private {
+		roomTXTs = append(roomTXTs, "proom="+tag)
+	}
+	for _, t := range roomTXTs {
+		// each string is prefixed by its length
+		size += len(t) + 1
+	}
+	if size > maxInlineRoomsSize {
+		// peers will fetch the full list from the peer API
+		roomTXTs = []string{"rooms=" + rooms.hash()}
+	}
+
+	txts := []string{fmt.Sprintf("proto=%v", protocolVersion)}
+	if d.quicPort != 0 {
+		txts = append(txts, fmt.Sprintf("quic=%v", d.quicPort))
+	}
+	txts = append(txts, presence.txts()...)
+	txts = append(txts, roomTXTs...)
+
+	for i, t := range txts {
+		txts[i] = escapeTXT(t)
+	}
+	return txts
+}
+
+// escapeTXT converts a TXT string into the presentation format expected by the DNS library (in which backslashes
+// introduce escape sequences)
+func escapeTXT(t string) string {
+	return strings.ReplaceAll(t, `\`, `\\`)
+}
+
+// unescapeTXT converts a TXT string from the DNS library's presentation format (in which special and non-ASCII bytes
+// are escaped as \X or \DDD) back into its raw form
+func unescapeTXT(t string) string {
+	if !strings.Contains(t, `\`) {
+		return t
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(t); i++ {
+		if t[i] != '\\' || i+1 == len(t) {
+			b.WriteByte(t[i])
+			continue
+		}
+
+		if i+3 < len(t) && isDigit(t[i+1]) && isDigit(t[i+2]) && isDigit(t[i+3]) {
+			n := int(t[i+1]-'0')*100 + int(t[i+2]-'0')*10 + int(t[i+3]-'0')
+			if n <= 255 {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+
+		b.WriteByte(t[i+1])
+		i++
+	}
+
+	return b.String()
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (d *MDNSDiscovery) updateTXTs() {
+	if d.server == nil {
+		// not yet started, TXT records will be set on registration
+		return
+	}
+
+	d.server.SetText(d.txts())
+}
+
+// SetPresence updates the presence advertised for this user
+func (d *MDNSDiscovery) SetPresence(p Presence) {
+	d.setPresence(p)
+	d.updateTXTs()
+}
+
+// SetRoomSecret makes a room private, advertising it by a tag derived from `secret` (or public if nil)
+func (d *MDNSDiscovery) SetRoomSecret(room string, secret []byte) {
+	d.setRoomSecret(room, secret)
+	d.updateTXTs()
+}
+
+// AddRoom adds a room to the list of rooms this user is in
+func (d *MDNSDiscovery) AddRoom(room string) bool {
+	if !d.addRoom(room) {
+		return false
+	}
+
+	d.updateTXTs()
+	return true
+}
+
+// RemoveRoom removes a room from the list of rooms this user is in
+func (d *MDNSDiscovery) RemoveRoom(room string) bool {
+	if !d.removeRoom(room) {
+		return false
+	}
+
+	d.updateTXTs()
+	return true
+}
+
+var (
+	mdnsGroupIPv4 = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	mdnsGroupIPv6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: 5353}
+)
+
+// mdnsEntry is a discovered service instance, along with the interface its addresses were received on
+type mdnsEntry struct {
+	*zeroconf.ServiceEntry
+	// Zone is the name of the interface (used to reach IPv6 link-local addresses)
+	Zone string
+}
+
+// mdnsPacket is an mDNS message and the index of the interface it was received on
+type mdnsPacket struct {
+	msg     *dns.Msg
+	ifIndex int
+}
+
+// mdnsBrowser continuously listens for DNS-SD responses for a service, keeping track of each instance's records
+// across packets (e.g. TXT updates and goodbyes which zeroconf.Resolver does not report)
+type mdnsBrowser struct {
+	service string
+	ifaces  []net.Interface
+
+	v4 *ipv4.PacketConn
+	v6 *ipv6.PacketConn
+
+	instances map[string]*zeroconf.ServiceEntry
+	hosts     map[string][]net.IP
+	// zones are the interfaces each host's addresses were last received on
+	zones map[string]string
+}
+
+func multicastInterfaces() []net.Interface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.WithError(err).Warn("Failed to list network interfaces")
+		return nil
+	}
+
+	multicast := []net.Interface{}
+	for _, i := range ifaces {
+		if i.Flags&net.FlagUp != 0 && i.Flags&net.FlagMulticast != 0 {
+			multicast = append(multicast, i)
+		}
+	}
+	return multicast
+}
+
+// newMDNSBrowser starts listening for mDNS traffic on all multicast interfaces
+func newMDNSBrowser(service, domain string) (*mdnsBrowser, error) {
+	b := &mdnsBrowser{
+		service: fmt.Sprintf("%v.%v", service, domain),
+		ifaces:  multicastInterfaces(),
+
+		instances: make(map[string]*zeroconf.ServiceEntry),
+		hosts:     make(map[string][]net.IP),
+		zones:     make(map[string]string),
+	}
+
+	// binding to the group address (rather than the wildcard) allows sharing the port with the responder
+	if conn, err := net.ListenUDP("udp4", mdnsGroupIPv4); err == nil {
+		b.v4 = ipv4.NewPacketConn(conn)
+		b.v4.SetControlMessage(ipv4.FlagInterface, true)
+		for _, i := range b.ifaces {
+			iface := i
+			b.v4.JoinGroup(&iface, mdnsGroupIPv4)
+		}
+	}
+	if conn, err := net.ListenUDP("udp6", mdnsGroupIPv6); err == nil {
+		b.v6 = ipv6.NewPacketConn(conn)
+		b.v6.SetControlMessage(ipv6.FlagInterface, true)
+		for _, i := range b.ifaces {
+			iface := i
+			b.v6.JoinGroup(&iface, mdnsGroupIPv6)
+		}
+	}
+
+	if b.v4 == nil && b.v6 == nil {
+		return nil, fmt.Errorf("failed to listen for mDNS traffic on IPv4 or IPv6")
+	}
+	return b, nil
+}
+
+// Close stops listening for mDNS traffic
+func (b *mdnsBrowser) Close() {
+	if b.v4 != nil {
+		b.v4.Close()
+	}
+	if b.v6 != nil {
+		b.v6.Close()
+	}
+}
+
+// Query asks all instances of the service to announce themselves
+func (b *mdnsBrowser) Query() error {
+	m := new(dns.Msg)
+	m.SetQuestion(b.service, dns.TypePTR)
+	m.RecursionDesired = false
+
+	buf, err := m.Pack()
+	if err != nil {
+		return fmt.Errorf("failed to pack mDNS query: %w", err)
+	}
+
+	sent := false
+	for _, i := range b.ifaces {
+		if b.v4 != nil {
+			if _, err := b.v4.WriteTo(buf, &ipv4.ControlMessage{IfIndex: i.Index}, mdnsGroupIPv4); err == nil {
+				sent = true
+			}
+		}
+		if b.v6 != nil {
+			if _, err := b.v6.WriteTo(buf, &ipv6.ControlMessage{IfIndex: i.Index}, mdnsGroupIPv6); err == nil {
+				sent = true
+			}
+		}
+	}
+
+	if !sent {
+		return fmt.Errorf("failed to send mDNS query on any interface")
+	}
+	return nil
+}
+
+// zone finds the name of the interface with index `i` (or "" if it isn't known)
+func (b *mdnsBrowser) zone(i int) string {
+	for _, iface := range b.ifaces {
+		if iface.Index == i {
+			return iface.Name
+		}
+	}
+
+	return ""
+}
+
+func (b *mdnsBrowser) recv(ctx context.Context, read func([]byte) (int, int, error), msgs chan<- mdnsPacket) {
+	buf := make([]byte, 65536)
+	for {
+		n, ifIndex, err := read(buf)
+		if err != nil {
+			// connection closed
+			return
+		}
+
+		msg := new(dns.Msg)
+		if err := msg.Unpack(buf[:n]); err != nil {
+			continue
+		}
+
+		select {
+		case msgs <- mdnsPacket{msg, ifIndex}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Browse sends new, updated and removed (with a TTL of 0) service instances to `entries` until `ctx` is cancelled
+func (b *mdnsBrowser) Browse(ctx context.Context, entries chan<- mdnsEntry) {
+	msgs := make(chan mdnsPacket, 32)
+	if b.v4 != nil {
+		go b.recv(ctx, func(buf []byte) (int, int, error) {
+			n, cm, _, err := b.v4.ReadFrom(buf)
+			if cm == nil {
+				return n, 0, err
+			}
+			return n, cm.IfIndex, err
+		}, msgs)
+	}
+	if b.v6 != nil {
+		go b.recv(ctx, func(buf []byte) (int, int, error) {
+			n, cm, _, err := b.v6.ReadFrom(buf)
+			if cm == nil {
+				return n, 0, err
+			}
+			return n, cm.IfIndex, err
+		}, msgs)
+	}
+
+	for {
+		select {
+		case p := <-msgs:
+			for _, e := range b.handle(p.msg, b.zone(p.ifIndex)) {
+				select {
+				case entries <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (b *mdnsBrowser) instance(name string) *zeroconf.ServiceEntry {
+	e, ok := b.instances[name]
+	if !ok {
+		e = zeroconf.NewServiceEntry(strings.TrimSuffix(name, "."+b.service), b.service, "")
+		b.instances[name] = e
+	}
+
+	return e
+}
+
+// handle updates the record cache from a response received on the interface `zone`, returning any entries which
+// changed
+func (b *mdnsBrowser) handle(msg *dns.Msg, zone string) []mdnsEntry {
+	if !msg.Response {
+		return nil
+	}
+
+	changed := make(map[string]bool)
+	goodbyes := []mdnsEntry{}
+	goodbye := func(name string) {
+		if e, ok := b.instances[name]; ok {
+			e.TTL = 0
+			goodbyes = append(goodbyes, mdnsEntry{ServiceEntry: e})
+			delete(b.instances, name)
+		}
+		delete(changed, name)
+	}
+
+	records := append(append(msg.Answer, msg.Ns...), msg.Extra...)
+	for _, rr := range records {
+		switch rr := rr.(type) {
+		case *dns.PTR:
+			if rr.Hdr.Name != b.service {
+				continue
+			}
+			if rr.Hdr.Ttl == 0 {
+				goodbye(rr.Ptr)
+				continue
+			}
+
+			b.instance(rr.Ptr).TTL = rr.Hdr.Ttl
+			changed[rr.Ptr] = true
+		case *dns.SRV:
+			if !strings.HasSuffix(rr.Hdr.Name, "."+b.service) {
+				continue
+			}
+			if rr.Hdr.Ttl == 0 {
+				goodbye(rr.Hdr.Name)
+				continue
+			}
+
+			e := b.instance(rr.Hdr.Name)
+			e.HostName = rr.Target
+			e.Port = int(rr.Port)
+			e.TTL = rr.Hdr.Ttl
+			changed[rr.Hdr.Name] = true
+		case *dns.TXT:
+			if !strings.HasSuffix(rr.Hdr.Name, "."+b.service) || rr.Hdr.Ttl == 0 {
+				continue
+			}
+
+			b.instance(rr.Hdr.Name).Text = rr.Txt
+			changed[rr.Hdr.Name] = true
+		}
+	}
+
+	// addresses in a response replace any previously seen for the host
+	addrs := make(map[string][]net.IP)
+	for _, rr := range records {
+		switch rr := rr.(type) {
+		case *dns.A:
+			addrs[rr.Hdr.Name] = append(addrs[rr.Hdr.Name], rr.A)
+		case *dns.AAAA:
+			addrs[rr.Hdr.Name] = append(addrs[rr.Hdr.Name], rr.AAAA)
+		}
+	}
+	for host, ips := range addrs {
+		b.hosts[host] = ips
+		b.zones[host] = zone
+		for name, e := range b.instances {
+			if e.HostName == host {
+				changed[name] = true
+			}
+		}
+	}
+
+	updated := goodbyes
+	for name := range changed {
+		e := b.instances[name]
+		if e.HostName == "" || e.Port == 0 || len(b.hosts[e.HostName]) == 0 {
+			// not fully resolved yet
+			continue
+		}
+
+		entry := *e
+		entry.AddrIPv4, entry.AddrIPv6 = nil, nil
+		for _, ip := range b.hosts[e.HostName] {
+			if ip.To4() != nil {
+				entry.AddrIPv4 = append(entry.AddrIPv4, ip)
+			} else {
+				entry.AddrIPv6 = append(entry.AddrIPv6, ip)
+			}
+		}
+		updated = append(updated, mdnsEntry{&entry, b.zones[e.HostName]})
+	}
+
+	return updated
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grandcat/zeroconf"
+	"github.com/miekg/dns"
+)
+
+func TestBrowserHandle(t *testing.T) {
+	service := srvName + "." + domain
+	b := &mdnsBrowser{
+		service:   service,
+		instances: make(map[string]*zeroconf.ServiceEntry),
+		hosts:     make(map[string][]net.IP),
+		zones:     make(map[string]string),
+	}
+
+	instance := "peer." + service
+	hdr := func(name string, rrtype uint16, ttl uint32) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+	}
+	announce := &dns.Msg{
+		MsgHdr: dns.MsgHdr{Response: true},
+		Answer: []dns.RR{
+			&dns.PTR{Hdr: hdr(service, dns.TypePTR, 120), Ptr: instance},
+			&dns.SRV{Hdr: hdr(instance, dns.TypeSRV, 120), Target: "peer.local.", Port: 1234},
+			&dns.TXT{Hdr: hdr(instance, dns.TypeTXT, 120), Txt: []string{"room=test"}},
+		},
+		Extra: []dns.RR{
+			&dns.A{Hdr: hdr("peer.local.", dns.TypeA, 120), A: net.IPv4(192, 0, 2, 1)},
+			&dns.AAAA{Hdr: hdr("peer.local.", dns.TypeAAAA, 120), AAAA: net.ParseIP("fe80::1")},
+		},
+	}
+
+	entries := b.handle(announce, "eth0")
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %v", len(entries))
+	}
+	e := entries[0]
+	if e.Port != 1234 || len(e.AddrIPv4) != 1 || len(e.AddrIPv6) != 1 || e.Zone != "eth0" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+
+	// a TXT update on its own should still produce an updated entry
+	update := &dns.Msg{
+		MsgHdr: dns.MsgHdr{Response: true},
+		Answer: []dns.RR{&dns.TXT{Hdr: hdr(instance, dns.TypeTXT, 120), Txt: []string{"room=other"}}},
+	}
+	if entries = b.handle(update, "eth0"); len(entries) != 1 || entries[0].Text[0] != "room=other" {
+		t.Errorf("expected TXT update, got %+v", entries)
+	}
+
+	goodbye := &dns.Msg{
+		MsgHdr: dns.MsgHdr{Response: true},
+		Answer: []dns.RR{&dns.PTR{Hdr: hdr(service, dns.TypePTR, 0), Ptr: instance}},
+	}
+	if entries = b.handle(goodbye, "eth0"); len(entries) != 1 || entries[0].TTL != 0 {
+		t.Errorf("expected goodbye, got %+v", entries)
+	}
+}
+
+func TestExpireMembers(t *testing.T) {
+	d := NewMDNSDiscovery(uuid.New(), 3)
+
+	stale, fresh := uuid.New(), uuid.New()
+	for _, id := range []uuid.UUID{stale, fresh} {
+		e := zeroconf.NewServiceEntry(id.String(), srvName, domain)
+		e.AddrIPv4 = []net.IP{net.IPv4(127, 0, 0, 1)}
+		e.Port = 1234
+		e.TTL = 120
+		e.Text = []string{"room=test"}
+		d.addEntry(mdnsEntry{ServiceEntry: e})
+	}
+
+	// pretend that the stale peer was last seen a while ago
+	cutoff := time.Now().Add(-time.Minute)
+	d.lock.Lock()
+	for i, m := range d.rooms["test"] {
+		if m.UUID == stale {
+			d.rooms["test"][i].LastSeen = cutoff.Add(-time.Second)
+		}
+	}
+	d.lock.Unlock()
+
+	d.expireMembers(cutoff)
+	members := d.GetRooms()["test"]
+	if len(members) != 1 || members[0].UUID != fresh {
+		t.Errorf("expected only the fresh peer to remain, got %+v", members)
+	}
+
+	d.lock.Lock()
+	d.rooms["test"][0].LastSeen = cutoff.Add(-time.Second)
+	d.lock.Unlock()
+	d.expireMembers(cutoff)
+	if _, ok := d.GetRooms()["test"]; ok {
+		t.Error("expected room to vanish once all of its members expired")
+	}
+}
+
+func TestDiscoveryEvents(t *testing.T) {
+	d := NewMDNSDiscovery(uuid.New(), 3)
+	events, cancel := d.Subscribe()
+	defer cancel()
+
+	e := zeroconf.NewServiceEntry(uuid.New().String(), srvName, domain)
+	e.AddrIPv4 = []net.IP{net.IPv4(127, 0, 0, 1)}
+	e.Port = 1234
+	e.TTL = 120
+	e.Text = []string{"room=test"}
+	d.addEntry(mdnsEntry{ServiceEntry: e})
+
+	e.TTL = 0
+	d.addEntry(mdnsEntry{ServiceEntry: e})
+
+	for _, expected := range []DiscoveryEventType{
+		EventRoomAppeared,
+		EventMemberJoined,
+		EventMemberLeft,
+		EventRoomVanished,
+	} {
+		var ev DiscoveryEvent
+		for ev.Type == "" || ev.Type == EventPresenceChanged {
+			select {
+			case ev = <-events:
+			case <-time.After(time.Second):
+				t.Fatalf("timed out waiting for %v event", expected)
+			}
+		}
+		if ev.Type != expected || ev.Room != "test" {
+			t.Fatalf("expected %v event for room test, got %+v", expected, ev)
+		}
+	}
+}
+
+func TestRoomListHash(t *testing.T) {
+	d := NewMDNSDiscovery(uuid.New(), 3)
+	d.AddRoom("test")
+	if txts := d.txts(); !contains(txts, "room=test") {
+		t.Errorf("expected small room list to be advertised inline, got %v", txts)
+	}
+
+	for i := 0; i < 20; i++ {
+		d.AddRoom(fmt.Sprintf("%v %v", strings.Repeat("x", 30), i))
+	}
+	rooms, _ := d.advertisement()
+	for _, txt := range d.txts() {
+		if strings.HasPrefix(txt, "room=") || strings.HasPrefix(txt, "proom=") {
+			t.Errorf("expected large room list to be replaced by a hash, got %q", txt)
+		}
+	}
+	if txts := d.txts(); !contains(txts, "rooms="+rooms.hash()) {
+		t.Errorf("expected rooms=%v, got %v", rooms.hash(), txts)
+	}
+
+	reversed := roomAdvert{Rooms: append([]string{}, rooms.Rooms...)}
+	for i, j := 0, len(reversed.Rooms)-1; i < j; i, j = i+1, j-1 {
+		reversed.Rooms[i], reversed.Rooms[j] = reversed.Rooms[j], reversed.Rooms[i]
+	}
+	if reversed.hash() != rooms.hash() {
+		t.Error("expected room list hash not to depend on order")
+	}
+	if (roomAdvert{Rooms: rooms.Rooms[1:]}).hash() == rooms.hash() {
+		t.Error("expected room list hash to change with the rooms")
+	}
+}
+
+func TestFetchRoomList(t *testing.T) {
+	a := newTestServer(t, NewMemoryRegistry())
+	b := newTestServer(t, NewMemoryRegistry())
+	trust(t, a, b)
+	uiRequest(t, b, http.MethodPost, "/api/rooms/test", "")
+
+	api := httptest.NewUnstartedServer(b.api.Handler)
+	api.Config.BaseContext = b.api.BaseContext
+	api.TLS = b.api.TLSConfig
+	api.StartTLS()
+	defer api.Close()
+
+	d := NewMDNSDiscovery(a.id, 3)
+	d.client = a.client
+
+	addr := api.Listener.Addr().(*net.TCPAddr)
+	e := zeroconf.NewServiceEntry(b.id.String(), srvName, domain)
+	e.AddrIPv4 = []net.IP{addr.IP}
+	e.Port = addr.Port
+	e.TTL = 120
+	e.Text = []string{"rooms=" + roomAdvert{Rooms: []string{"test"}}.hash()}
+	d.addEntry(mdnsEntry{ServiceEntry: e})
+
+	eventually(t, "room list to be fetched", func() bool {
+		members := d.GetRooms()["test"]
+		return len(members) == 1 && members[0].UUID == b.id
+	})
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func FuzzTXTEscapeRoundTrip(f *testing.F) {
+	for _, s := range []string{"room=test", `room=back\slash`, `room="quoted"`, "room=café", "\x00\xff", `\065`} {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, txt string) {
+		// a single TXT string can't be longer than 255 bytes
+		if len(txt) > 255 {
+			return
+		}
+
+		msg := new(dns.Msg)
+		msg.Answer = []dns.RR{&dns.TXT{
+			Hdr: dns.RR_Header{Name: "test.local.", Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: []string{escapeTXT(txt)},
+		}}
+		packed, err := msg.Pack()
+		if err != nil {
+			t.Fatalf("failed to pack %q: %v", txt, err)
+		}
+
+		var unpacked dns.Msg
+		if err := unpacked.Unpack(packed); err != nil {
+			t.Fatalf("failed to unpack %q: %v", txt, err)
+		}
+		got := unpacked.Answer[0].(*dns.TXT).Txt
+		if len(got) != 1 || unescapeTXT(got[0]) != txt {
+			t.Errorf("%q was received as %q", txt, got)
+		}
+	})
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MemoryRegistry allows servers in the same process to discover each other without any network traffic (e.g. for
+// tests)
+type MemoryRegistry struct {
+	lock  sync.Mutex
+	nodes map[uuid.UUID]*MemoryDiscovery
+}
+
+// NewMemoryRegistry creates a new, empty in-memory registry
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{
+		nodes: make(map[uuid.UUID]*MemoryDiscovery),
+	}
+}
+
+// NewDiscovery creates a discovery backend for a server which uses the registry (suitable for Config.Discovery)
+func (r *MemoryRegistry) NewDiscovery(id uuid.UUID) Discovery {
+	return &MemoryDiscovery{
+		peerTable: newPeerTable(),
+
+		id:       id,
+		registry: r,
+		quit:     make(chan struct{}),
+	}
+}
+
+// join adds a node to the registry, exchanging advertisements with all existing nodes
+func (r *MemoryRegistry) join(d *MemoryDiscovery) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	member, rooms := d.member()
+	for _, n := range r.nodes {
+		n.updateMember(member, rooms)
+
+		m, rs := n.member()
+		d.updateMember(m, rs)
+	}
+
+	r.nodes[d.id] = d
+}
+
+// leave removes a node from the registry
+func (r *MemoryRegistry) leave(d *MemoryDiscovery) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.nodes[d.id]; !ok {
+		return
+	}
+
+	delete(r.nodes, d.id)
+	for _, n := range r.nodes {
+		n.removeMember(d.id)
+	}
+}
+
+// announce sends a node's current advertisement to all other nodes
+func (r *MemoryRegistry) announce(d *MemoryDiscovery) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.nodes[d.id]; !ok {
+		// not yet started
+		return
+	}
+
+	member, rooms := d.member()
+	for id, n := range r.nodes {
+		if id != d.id {
+			n.updateMember(member, rooms)
+		}
+	}
+}
+
+// MemoryDiscovery is a discovery backend which finds peers through a MemoryRegistry
+type MemoryDiscovery struct {
+	peerTable
+
+	id       uuid.UUID
+	registry *MemoryRegistry
+	port     int
+	quicPort int
+
+	closeOnce sync.Once
+	quit      chan struct{}
+}
+
+// member builds the advertisement other nodes see for this node
+func (d *MemoryDiscovery) member() (RoomMember, roomAdvert) {
+	rooms, presence := d.advertisement()
+
+	return RoomMember{
+		UUID:     d.id,
+		Addrs:    []net.IP{net.IPv6loopback, net.IPv4(127, 0, 0, 1)},
+		Port:     d.port,
+		Version:  protocolVersion,
+		QUICPort: d.quicPort,
+		Presence: presence,
+		LastSeen: time.Now(),
+	}, rooms
+}
+
+// Start makes this node visible to others in the registry until Close is called
+func (d *MemoryDiscovery) Start(apiPort, quicPort int) error {
+	d.port = apiPort
+	d.quicPort = quicPort
+	d.registry.join(d)
+
+	<-d.quit
+	return nil
+}
+
+// Close removes this node from the registry
+func (d *MemoryDiscovery) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.quit)
+		d.registry.leave(d)
+		d.events.close()
+	})
+
+	return nil
+}
+
+// SetPresence updates the presence advertised for this user
+func (d *MemoryDiscovery) SetPresence(p Presence) {
+	d.setPresence(p)
+	d.registry.announce(d)
+}
+
+// SetRoomSecret makes a room private, advertising it by a tag derived from `secret` (or public if nil)
+func (d *MemoryDiscovery) SetRoomSecret(room string, secret []byte) {
+	d.setRoomSecret(room, secret)
+	d.registry.announce(d)
+}
+
+// AddRoom adds a room to the list of rooms this user is in
+func (d *MemoryDiscovery) AddRoom(room string) bool {
+	if !d.addRoom(room) {
+		return false
+	}
+
+	d.registry.announce(d)
+	return true
+}
+
+// RemoveRoom removes a room from the list of rooms this user is in
+func (d *MemoryDiscovery) RemoveRoom(room string) bool {
+	if !d.removeRoom(room) {
+		return false
+	}
+
+	d.registry.announce(d)
+	return true
+}
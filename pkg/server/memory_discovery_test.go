@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestServer starts a server on the loopback interface which discovers others through `registry`
+func newTestServer(t *testing.T, registry *MemoryRegistry) *Server {
+	t.Helper()
+
+	return newTestServerConfig(t, Config{Discovery: registry.NewDiscovery})
+}
+
+// newTestServerConfig starts a server on the loopback interface with a fresh database
+func newTestServerConfig(t *testing.T, config Config) *Server {
+	t.Helper()
+
+	s := newUnstartedTestServer(t, config)
+	startTestServer(t, s)
+	return s
+}
+
+// newUnstartedTestServer creates a server with a fresh database, without starting it
+func newUnstartedTestServer(t *testing.T, config Config) *Server {
+	t.Helper()
+
+	config.DBPath = filepath.Join(t.TempDir(), "test.db")
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	t.Cleanup(func() {
+		s.Close()
+	})
+	return s
+}
+
+// startTestServer starts a server on the loopback interface
+func startTestServer(t *testing.T, s *Server) {
+	t.Helper()
+
+	go s.Listen("127.0.0.1:0", "127.0.0.1:0")
+
+	// joined rooms are restored just before discovery starts, so wait for that before the test joins any
+	eventually(t, "server to start", func() bool {
+		return started(s)
+	})
+}
+
+// started checks if a server's in-memory discovery has joined its registry (always true for other backends)
+func started(s *Server) bool {
+	for _, d := range s.discovery.(multiDiscovery) {
+		if m, ok := d.(*MemoryDiscovery); ok {
+			m.registry.lock.Lock()
+			defer m.registry.lock.Unlock()
+
+			_, ok := m.registry.nodes[m.id]
+			return ok
+		}
+	}
+
+	return true
+}
+
+// trust marks each server's user as verified by the other, so that they can connect without user interaction
+func trust(t *testing.T, a, b *Server) {
+	t.Helper()
+
+	for _, p := range [][2]*Server{{a, b}, {b, a}} {
+		u, err := p[0].userForCert(p[1].cert.Leaf.Raw)
+		if err != nil {
+			t.Fatalf("failed to add user: %v", err)
+		}
+		if err := p[0].setUserVerified(&u, true); err != nil {
+			t.Fatalf("failed to verify user: %v", err)
+		}
+	}
+}
+
+// uiRequest makes a request to a server's UI API, failing the test if it doesn't succeed
+func uiRequest(t *testing.T, s *Server, method, path, body string) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	s.ui.Handler.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+	if w.Code >= 400 {
+		t.Fatalf("%v %v failed with HTTP %v: %v", method, path, w.Code, w.Body)
+	}
+}
+
+// eventually waits for `cond` to become true, failing the test if it doesn't within a few seconds
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// inRoom checks if a server has discovered `member` in a room
+func inRoom(s *Server, room string, member *Server) bool {
+	for _, m := range s.discovery.GetRooms()[room] {
+		if m.UUID == member.id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestMemoryDiscovery(t *testing.T) {
+	registry := NewMemoryRegistry()
+	a := newTestServer(t, registry)
+	b := newTestServer(t, registry)
+	trust(t, a, b)
+
+	uiRequest(t, a, http.MethodPost, "/api/rooms/test", "")
+	uiRequest(t, b, http.MethodPost, "/api/rooms/test", "")
+	eventually(t, "members to see each other join", func() bool {
+		return inRoom(a, "test", b) && inRoom(b, "test", a)
+	})
+
+	uiRequest(t, a, http.MethodPost, "/api/rooms/test/message", `{"username":"a","content":"hello"}`)
+	eventually(t, "message to be delivered", func() bool {
+		history, err := b.getRoomHistory("test")
+		if err != nil {
+			t.Fatalf("failed to retrieve history: %v", err)
+		}
+
+		return len(history) == 1 && history[0].Content == "hello" && history[0].Sender == a.id
+	})
+
+	uiRequest(t, a, http.MethodDelete, "/api/rooms/test", "")
+	eventually(t, "member to be seen leaving", func() bool {
+		return !inRoom(b, "test", a)
+	})
+}
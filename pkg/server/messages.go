@@ -0,0 +1,460 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/mattn/go-sqlite3"
+	log "github.com/sirupsen/logrus"
+)
+
+const sweepInterval = 5 * time.Second
+
+var errMessageNotFound = errors.New("message not found")
+
+// errDuplicateMessage means a message with the same ID has already been stored
+var errDuplicateMessage = errors.New("message already stored")
+
+// errEditSuperseded means a newer edit (or deletion) of a message has already been applied
+var errEditSuperseded = errors.New("message has a newer edit")
+
+// Message represents a message stored in a room's history
+type Message struct {
+	ID       uuid.UUID
+	Room     string
+	Sender   uuid.UUID
+	Username string
+	Content  string
+	Sent     time.Time
+	Edited   sql.NullTime
+	Deleted  bool
+
+	// ReplyTo is the message this message is a reply to (or uuid.Nil)
+	ReplyTo uuid.UUID
+	// Thread is the first message in the thread this message belongs to (or uuid.Nil)
+	Thread uuid.UUID
+	// Expires is the time after which the message should be purged
+	Expires sql.NullTime
+	// Signature is the sender's signature of the original message (nil if the sender didn't sign it)
+	Signature []byte
+	// Clock is the sender's Lamport clock for the room when the message was sent, which orders messages causally
+	Clock int64
+}
+
+// MessageEdit represents a previous version of an edited message
+type MessageEdit struct {
+	Content string
+	Time    time.Time
+}
+
+// signedMessage is the form of a message which its sender signs
+type signedMessage struct {
+	ID       uuid.UUID  `json:"id"`
+	Room     string     `json:"room"`
+	Sender   uuid.UUID  `json:"sender"`
+	Username string     `json:"username"`
+	Content  string     `json:"content"`
+	Sent     time.Time  `json:"sent"`
+	ReplyTo  uuid.UUID  `json:"reply_to"`
+	Thread   uuid.UUID  `json:"thread"`
+	Expires  *time.Time `json:"expires"`
+	Clock    int64      `json:"clock"`
+}
+
+// signingData produces the data signed by a message's sender (covering the message as originally sent)
+func (m Message) signingData() []byte {
+	sm := signedMessage{
+		ID:       m.ID,
+		Room:     m.Room,
+		Sender:   m.Sender,
+		Username: m.Username,
+		Content:  m.Content,
+		Sent:     m.Sent.UTC(),
+		ReplyTo:  m.ReplyTo,
+		Thread:   m.Thread,
+		Clock:    m.Clock,
+	}
+	if m.Expires.Valid {
+		expires := m.Expires.Time.UTC()
+		sm.Expires = &expires
+	}
+
+	// encoding a struct of simple types can't fail
+	data, _ := json.Marshal(sm)
+	return data
+}
+
+// checkMessageSignature verifies that a message was signed by its sender
+func (s *Server) checkMessageSignature(m Message) error {
+	if m.Signature == nil {
+		return errors.New("message is not signed")
+	}
+
+	cert, err := s.certFor(m.Sender)
+	if err != nil {
+		return err
+	}
+	if err := checkSignature(cert, m.signingData(), m.Signature); err != nil {
+		return fmt.Errorf("invalid message signature: %w", err)
+	}
+	return nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanMessage(row rowScanner) (Message, error) {
+	var m Message
+	err := row.Scan(&m.ID, &m.Room, &m.Sender, &m.Username, &m.Content, &m.Sent, &m.Edited, &m.Deleted, &m.ReplyTo,
+		&m.Thread, &m.Expires, &m.Signature, &m.Clock)
+	return m, err
+}
+
+func scanMessages(rows *sql.Rows) ([]Message, error) {
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read message from query result: %w", err)
+		}
+
+		messages = append(messages, m)
+	}
+
+	return messages, rows.Err()
+}
+
+// nullTime converts a time into a value suitable for a nullable database column
+func nullTime(t sql.NullTime) interface{} {
+	if !t.Valid {
+		return nil
+	}
+
+	return t.Time.UTC()
+}
+
+// nullUUID converts a UUID into a value suitable for a nullable database column
+func nullUUID(id uuid.UUID) interface{} {
+	if id == uuid.Nil {
+		return nil
+	}
+
+	return id[:]
+}
+
+func (s *Server) addMessage(m Message) error {
+	// times are stored in UTC so that they can be compared in queries
+	if _, err := s.stmts.addMessage.Exec(m.ID[:], m.Room, m.Sender[:], m.Username, m.Content, m.Sent.UTC(),
+		nullUUID(m.ReplyTo), nullUUID(m.Thread), nullTime(m.Expires), m.Signature, m.Clock); err != nil {
+		var sqlErr sqlite3.Error
+		if errors.As(err, &sqlErr) && sqlErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+			return errDuplicateMessage
+		}
+		return fmt.Errorf("failed to insert message into database: %w", err)
+	}
+
+	return nil
+}
+
+// roomClock retrieves the highest clock of any message seen in a room
+func (s *Server) roomClock(room string) (int64, error) {
+	var clock int64
+	if err := s.stmts.roomClock.QueryRow(room).Scan(&clock); err != nil {
+		return 0, fmt.Errorf("failed to retrieve room clock from database: %w", err)
+	}
+
+	return clock, nil
+}
+
+// nextClock advances this user's Lamport clock for a room, returning the value to be used for a new message (one more
+// than that of any message seen in the room). s.clockLock must be held until the message has been stored.
+func (s *Server) nextClock(room string) (int64, error) {
+	clock, err := s.roomClock(room)
+	if err != nil {
+		return 0, err
+	}
+
+	return clock + 1, nil
+}
+
+func (s *Server) getMessage(id uuid.UUID) (Message, error) {
+	m, err := scanMessage(s.stmts.retrieveMessage.QueryRow(id[:]))
+	if errors.Is(err, sql.ErrNoRows) {
+		return m, errMessageNotFound
+	}
+	if err != nil {
+		return m, fmt.Errorf("failed to retrieve message from database: %w", err)
+	}
+
+	return m, nil
+}
+
+func (s *Server) getRoomHistory(room string) ([]Message, error) {
+	rows, err := s.stmts.roomHistory.Query(room)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database for room history: %w", err)
+	}
+
+	return scanMessages(rows)
+}
+
+// getThread retrieves the replies in the thread started by a message
+func (s *Server) getThread(id uuid.UUID) ([]Message, error) {
+	rows, err := s.stmts.threadMessages.Query(id[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database for thread: %w", err)
+	}
+
+	return scanMessages(rows)
+}
+
+// threadFor determines the thread a reply to `parent` belongs to
+func threadFor(parent Message) uuid.UUID {
+	if parent.Thread != uuid.Nil {
+		return parent.Thread
+	}
+
+	return parent.ID
+}
+
+// editMessage replaces the content of a message, keeping the previous content in the message's edit trail
+func (s *Server) editMessage(m *Message, content string, t time.Time) error {
+	if m.Deleted {
+		return errors.New("message has been deleted")
+	}
+	if m.Edited.Valid && !t.After(m.Edited.Time) {
+		return errEditSuperseded
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Stmt(s.stmts.addMessageEdit).Exec(m.ID[:], m.Content, m.lastModified().UTC()); err != nil {
+		return fmt.Errorf("failed to add message edit trail entry: %w", err)
+	}
+	if _, err := tx.Stmt(s.stmts.editMessage).Exec(content, t.UTC(), m.ID[:]); err != nil {
+		return fmt.Errorf("failed to update message: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit message edit: %w", err)
+	}
+
+	m.Content = content
+	m.Edited = sql.NullTime{Time: t, Valid: true}
+	return nil
+}
+
+// deleteMessage retracts a message, leaving a tombstone in the room's history and discarding the edit trail
+func (s *Server) deleteMessage(m *Message, t time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Stmt(s.stmts.clearMessageEdits).Exec(m.ID[:]); err != nil {
+		return fmt.Errorf("failed to clear message edit trail: %w", err)
+	}
+	if _, err := tx.Stmt(s.stmts.deleteMessage).Exec(t.UTC(), m.ID[:]); err != nil {
+		return fmt.Errorf("failed to delete message: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit message deletion: %w", err)
+	}
+
+	m.Content = ""
+	m.Edited = sql.NullTime{Time: t, Valid: true}
+	m.Deleted = true
+	return nil
+}
+
+func (s *Server) getMessageEdits(id uuid.UUID) ([]MessageEdit, error) {
+	rows, err := s.stmts.retrieveMessageEdits.Query(id[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database for message edits: %w", err)
+	}
+	defer rows.Close()
+
+	edits := []MessageEdit{}
+	for rows.Next() {
+		var e MessageEdit
+		if err := rows.Scan(&e.Content, &e.Time); err != nil {
+			return nil, fmt.Errorf("failed to read message edit from query result: %w", err)
+		}
+
+		edits = append(edits, e)
+	}
+
+	return edits, rows.Err()
+}
+
+// setTTL makes the message expire `ttl` seconds after it was sent (or never if `ttl` is 0)
+func (m *Message) setTTL(ttl int) {
+	if ttl <= 0 {
+		m.Expires = sql.NullTime{}
+		return
+	}
+
+	m.Expires = sql.NullTime{Time: m.Sent.Add(time.Duration(ttl) * time.Second), Valid: true}
+}
+
+func (m Message) expired() bool {
+	return m.Expires.Valid && !m.Expires.Time.After(time.Now())
+}
+
+func (m Message) lastModified() time.Time {
+	if m.Edited.Valid {
+		return m.Edited.Time
+	}
+
+	return m.Sent
+}
+
+const maxReactionLength = 32
+
+func validReaction(emoji string) bool {
+	if emoji == "" || len(emoji) > maxReactionLength || !utf8.ValidString(emoji) {
+		return false
+	}
+
+	for _, r := range emoji {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// setReaction adds or removes a user's reaction to a message, returning the new number of users with that reaction
+func (s *Server) setReaction(m Message, user uuid.UUID, emoji string, add bool) (int, error) {
+	stmt := s.stmts.removeReaction
+	if add {
+		stmt = s.stmts.addReaction
+	}
+	if _, err := stmt.Exec(m.ID[:], user[:], emoji); err != nil {
+		return 0, fmt.Errorf("failed to update reaction: %w", err)
+	}
+
+	counts, err := s.getMessageReactions(m.ID)
+	if err != nil {
+		return 0, err
+	}
+	return counts[m.ID][emoji], nil
+}
+
+// reactionCounts maps message IDs to the number of users who reacted with each emoji
+type reactionCounts map[uuid.UUID]map[string]int
+
+func queryReactionCounts(stmt *sql.Stmt, arg interface{}) (reactionCounts, error) {
+	rows, err := stmt.Query(arg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database for reactions: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(reactionCounts)
+	for rows.Next() {
+		var (
+			id    uuid.UUID
+			emoji string
+			count int
+		)
+		if err := rows.Scan(&id, &emoji, &count); err != nil {
+			return nil, fmt.Errorf("failed to read reaction from query result: %w", err)
+		}
+
+		if _, ok := counts[id]; !ok {
+			counts[id] = make(map[string]int)
+		}
+		counts[id][emoji] = count
+	}
+
+	return counts, rows.Err()
+}
+
+func (s *Server) getRoomReactions(room string) (reactionCounts, error) {
+	return queryReactionCounts(s.stmts.roomReactions, room)
+}
+
+func (s *Server) getMessageReactions(id uuid.UUID) (reactionCounts, error) {
+	return queryReactionCounts(s.stmts.messageReactions, id[:])
+}
+
+// purgeExpired deletes all messages which have expired, returning them (with only their ID and room set)
+func (s *Server) purgeExpired(now time.Time) ([]Message, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Stmt(s.stmts.expiredMessages).Query(now.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database for expired messages: %w", err)
+	}
+
+	expired := []Message{}
+	for rows.Next() {
+		var m Message
+		if err := rows.Scan(&m.ID, &m.Room); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read expired message from query result: %w", err)
+		}
+
+		expired = append(expired, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read expired messages: %w", err)
+	}
+
+	if _, err := tx.Stmt(s.stmts.deleteExpiredMessages).Exec(now.UTC()); err != nil {
+		return nil, fmt.Errorf("failed to delete expired messages: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit expired message deletion: %w", err)
+	}
+
+	return expired, nil
+}
+
+// sweepExpired periodically purges expired messages until `quit` is closed
+func (s *Server) sweepExpired(quit <-chan struct{}) {
+	t := time.NewTicker(sweepInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case now := <-t.C:
+			expired, err := s.purgeExpired(now)
+			if err != nil {
+				log.WithError(err).Error("Failed to purge expired messages")
+				continue
+			}
+
+			for _, m := range expired {
+				s.publishJSONEvent(streamMessages, eventMessageExpire, uiEventExpire{
+					ID:   m.ID.String(),
+					Room: m.Room,
+				})
+			}
+			if len(expired) > 0 {
+				log.WithField("count", len(expired)).Debug("Purged expired messages")
+			}
+		case <-quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestEditMessage(t *testing.T) {
+	s := newTestServer(t, NewMemoryRegistry())
+
+	sent := time.Now().UTC()
+	m := Message{
+		ID:       uuid.New(),
+		Room:     "test",
+		Sender:   uuid.New(),
+		Username: "sender",
+		Content:  "original",
+		Sent:     sent,
+	}
+	if err := s.addMessage(m); err != nil {
+		t.Fatalf("failed to add message: %v", err)
+	}
+
+	if err := s.editMessage(&m, "edited", sent.Add(time.Second)); err != nil {
+		t.Fatalf("failed to edit message: %v", err)
+	}
+	stored, err := s.getMessage(m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Content != "edited" || !stored.Edited.Valid {
+		t.Errorf("expected message to have been edited, got %+v", stored)
+	}
+	edits, err := s.getMessageEdits(m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(edits) != 1 || edits[0].Content != "original" {
+		t.Errorf("expected the original content in the edit trail, got %+v", edits)
+	}
+
+	if err := s.deleteMessage(&m, sent.Add(2*time.Second)); err != nil {
+		t.Fatalf("failed to delete message: %v", err)
+	}
+	stored, err = s.getMessage(m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Content != "" || !stored.Deleted {
+		t.Errorf("expected message to have been deleted, got %+v", stored)
+	}
+	if edits, err = s.getMessageEdits(m.ID); err != nil {
+		t.Fatal(err)
+	}
+	if len(edits) != 0 {
+		t.Errorf("expected the edit trail to have been discarded, got %+v", edits)
+	}
+	if err := s.editMessage(&stored, "too late", sent.Add(3*time.Second)); err == nil {
+		t.Error("edited a deleted message")
+	}
+}
+
+func TestEditOrder(t *testing.T) {
+	s := newTestServer(t, NewMemoryRegistry())
+
+	sent := time.Now().UTC()
+	m := Message{
+		ID:       uuid.New(),
+		Room:     "test",
+		Sender:   uuid.New(),
+		Username: "sender",
+		Content:  "original",
+		Sent:     sent,
+	}
+	if err := s.addMessage(m); err != nil {
+		t.Fatalf("failed to add message: %v", err)
+	}
+
+	// the second edit arrives before the first
+	edits := []struct {
+		content string
+		time    time.Time
+	}{
+		{"second", sent.Add(2 * time.Second)},
+		{"first", sent.Add(time.Second)},
+	}
+	for i, e := range edits {
+		m, err := s.getMessage(m.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.editMessage(&m, e.content, e.time)
+		if i == 0 && err != nil {
+			t.Fatalf("failed to edit message: %v", err)
+		}
+		if i == 1 && !errors.Is(err, errEditSuperseded) {
+			t.Errorf("expected older edit to be superseded, got %v", err)
+		}
+	}
+
+	m, err := s.getMessage(m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Content != "second" {
+		t.Errorf("expected content to be %q, got %q", "second", m.Content)
+	}
+	trail, err := s.getMessageEdits(m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trail) != 1 || trail[0].Content != "original" {
+		t.Errorf("expected only the original content in the edit trail, got %+v", trail)
+	}
+}
+
+func TestThreadsAndReactions(t *testing.T) {
+	s := newTestServer(t, NewMemoryRegistry())
+
+	sent := time.Now().UTC()
+	add := func(content string, parent *Message) Message {
+		t.Helper()
+
+		m := Message{
+			ID:       uuid.New(),
+			Room:     "test",
+			Sender:   uuid.New(),
+			Username: "sender",
+			Content:  content,
+			Sent:     sent,
+		}
+		if parent != nil {
+			m.ReplyTo = parent.ID
+			m.Thread = threadFor(*parent)
+		}
+		if err := s.addMessage(m); err != nil {
+			t.Fatalf("failed to add message: %v", err)
+		}
+		return m
+	}
+	root := add("root", nil)
+	reply := add("reply", &root)
+	nested := add("reply to reply", &reply)
+
+	if nested.Thread != root.ID {
+		t.Errorf("expected a reply to a reply to be in the root's thread, got %v", nested.Thread)
+	}
+	thread, err := s.getThread(root.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(thread) != 2 {
+		t.Errorf("expected 2 messages in thread, got %v", len(thread))
+	}
+
+	for _, emoji := range []string{"", " ", "a\nb", strings.Repeat("x", maxReactionLength+1)} {
+		if validReaction(emoji) {
+			t.Errorf("expected %q to be an invalid reaction", emoji)
+		}
+	}
+
+	users := []uuid.UUID{uuid.New(), uuid.New()}
+	for i, u := range users {
+		count, err := s.setReaction(root, u, "👍", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != i+1 {
+			t.Errorf("expected %v reactions, got %v", i+1, count)
+		}
+	}
+	// reacting twice with the same emoji only counts once
+	if count, err := s.setReaction(root, users[0], "👍", true); err != nil || count != 2 {
+		t.Errorf("expected 2 reactions after reacting again, got %v (error %v)", count, err)
+	}
+	if count, err := s.setReaction(root, users[0], "👍", false); err != nil || count != 1 {
+		t.Errorf("expected 1 reaction after removing one, got %v (error %v)", count, err)
+	}
+}
+
+func TestPurgeExpired(t *testing.T) {
+	s := newTestServer(t, NewMemoryRegistry())
+
+	sent := time.Now().UTC()
+	messages := make([]Message, 3)
+	for i, ttl := range []int{0, 10, 60} {
+		messages[i] = Message{
+			ID:       uuid.New(),
+			Room:     "test",
+			Sender:   uuid.New(),
+			Username: "sender",
+			Content:  "hello",
+			Sent:     sent,
+		}
+		messages[i].setTTL(ttl)
+		if err := s.addMessage(messages[i]); err != nil {
+			t.Fatalf("failed to add message: %v", err)
+		}
+	}
+
+	expired, err := s.purgeExpired(sent.Add(30 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || expired[0].ID != messages[1].ID {
+		t.Errorf("expected only the message with a 10 second TTL to expire, got %+v", expired)
+	}
+
+	history, err := s.getRoomHistory("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 {
+		t.Errorf("expected 2 messages to remain, got %v", len(history))
+	}
+}
+
+func TestClockOrder(t *testing.T) {
+	s := newTestServer(t, NewMemoryRegistry())
+
+	// the sender of the reply has a clock running an hour behind
+	now := time.Now().UTC()
+	original := Message{
+		ID:       uuid.New(),
+		Room:     "test",
+		Sender:   uuid.New(),
+		Username: "a",
+		Content:  "question",
+		Sent:     now,
+		Clock:    4,
+	}
+	reply := Message{
+		ID:       uuid.New(),
+		Room:     "test",
+		Sender:   uuid.New(),
+		Username: "b",
+		Content:  "answer",
+		Sent:     now.Add(-time.Hour),
+		Clock:    5,
+	}
+	for _, m := range []Message{reply, original} {
+		if err := s.addMessage(m); err != nil {
+			t.Fatalf("failed to add message: %v", err)
+		}
+	}
+
+	history, err := s.getRoomHistory("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].ID != original.ID || history[1].ID != reply.ID {
+		t.Errorf("expected history to be ordered by clock, got %+v", history)
+	}
+
+	clock, err := s.nextClock("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clock != 6 {
+		t.Errorf("expected next clock to be 6, got %v", clock)
+	}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const maxTopicLength = 256
+const maxDescriptionLength = 1024
+
+// maxMetadataSkew is how far ahead of the local clock a change to a room's metadata can claim to have been made (any
+// further and it could win over every change made until then)
+const maxMetadataSkew = 5 * time.Minute
+
+// RoomMetadata is descriptive information about a room which any member (or only admins, if the room has a manifest)
+// can change
+type RoomMetadata struct {
+	Room        string `json:"room"`
+	Topic       string `json:"topic"`
+	Description string `json:"description"`
+	// IconHash is the hex-encoded SHA-256 hash of the room's icon (if it has one)
+	IconHash string    `json:"icon_hash"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+	// UpdatedBy is the user who made (and signed) the latest change
+	UpdatedBy uuid.UUID `json:"updated_by"`
+}
+
+func (m RoomMetadata) validate() error {
+	if len(m.Topic) > maxTopicLength {
+		return fmt.Errorf("topic cannot be longer than %v bytes", maxTopicLength)
+	}
+	if len(m.Description) > maxDescriptionLength {
+		return fmt.Errorf("description cannot be longer than %v bytes", maxDescriptionLength)
+	}
+	if m.IconHash != "" {
+		if h, err := hex.DecodeString(m.IconHash); err != nil || len(h) != 32 {
+			return errors.New("icon hash must be a hex-encoded SHA-256 hash")
+		}
+	}
+
+	return nil
+}
+
+// newerThan checks if a version of a room's metadata supersedes another (the latest change wins, with ties broken by
+// UUID so that all members settle on the same version)
+func (m RoomMetadata) newerThan(o RoomMetadata) bool {
+	if !m.Updated.Equal(o.Updated) {
+		return m.Updated.After(o.Updated)
+	}
+
+	return bytes.Compare(m.UpdatedBy[:], o.UpdatedBy[:]) > 0
+}
+
+// getMetadata retrieves a room's metadata, returning nil if none has been set
+func (s *Server) getMetadata(room string) (*RoomMetadata, signedPayload, error) {
+	var p signedPayload
+	if err := s.stmts.getRoomMetadata.QueryRow(room).Scan(&p.Payload, &p.Signature); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, p, nil
+		}
+
+		return nil, p, fmt.Errorf("failed to retrieve room metadata from database: %w", err)
+	}
+
+	var m RoomMetadata
+	if err := json.Unmarshal(p.Payload, &m); err != nil {
+		return nil, p, fmt.Errorf("failed to parse stored room metadata: %w", err)
+	}
+	return &m, p, nil
+}
+
+// canEditMetadata checks if a user is allowed to change a room's metadata
+func (s *Server) canEditMetadata(room string, id uuid.UUID) error {
+	manifest, _, err := s.getManifest(room)
+	if err != nil {
+		return err
+	}
+	if manifest != nil && !manifest.isAdmin(id) {
+		return errNotAdmin
+	}
+
+	return nil
+}
+
+// acceptMetadata stores metadata received from a peer if it is newer than the current version, returning whether or
+// not it was
+func (s *Server) acceptMetadata(room string, p signedPayload) (RoomMetadata, bool, error) {
+	var m RoomMetadata
+	if err := s.openPayload(p, &m, func() uuid.UUID { return m.UpdatedBy }); err != nil {
+		return m, false, err
+	}
+	if m.Room != room {
+		return m, false, errors.New("metadata is for a different room")
+	}
+	if err := m.validate(); err != nil {
+		return m, false, err
+	}
+	if m.Updated.After(time.Now().Add(maxMetadataSkew)) {
+		return m, false, errors.New("metadata was updated too far in the future")
+	}
+	if err := s.canEditMetadata(room, m.UpdatedBy); err != nil {
+		return m, false, err
+	}
+
+	old, _, err := s.getMetadata(room)
+	if err != nil {
+		return m, false, err
+	}
+	if old != nil && !m.newerThan(*old) {
+		return *old, false, nil
+	}
+
+	if _, err := s.stmts.setRoomMetadata.Exec(room, p.Payload, p.Signature); err != nil {
+		return m, false, fmt.Errorf("failed to store room metadata: %w", err)
+	}
+	return m, true, nil
+}
+
+// updateMetadata applies a change to a room's metadata, signs it and distributes it to the room's members
+func (s *Server) updateMetadata(room string, update func(m *RoomMetadata)) (RoomMetadata, error) {
+	if err := s.canEditMetadata(room, s.id); err != nil {
+		return RoomMetadata{}, err
+	}
+
+	old, _, err := s.getMetadata(room)
+	if err != nil {
+		return RoomMetadata{}, err
+	}
+
+	now := time.Now().UTC()
+	m := RoomMetadata{
+		Room:    room,
+		Created: now,
+	}
+	if old != nil {
+		m = *old
+	}
+
+	update(&m)
+	if err := m.validate(); err != nil {
+		return m, err
+	}
+	if old != nil && !now.After(old.Updated) {
+		// make sure the change wins even if the previous author's clock is ahead
+		now = old.Updated.Add(time.Millisecond)
+	}
+	m.Updated = now
+	m.UpdatedBy = s.id
+
+	p, err := s.signPayload(m)
+	if err != nil {
+		return m, err
+	}
+	if _, err := s.stmts.setRoomMetadata.Exec(room, p.Payload, p.Signature); err != nil {
+		return m, fmt.Errorf("failed to store room metadata: %w", err)
+	}
+
+	s.publishJSONEvent(streamRooms, eventMetadata, m)
+	s.sendToRoom(room, http.MethodPut, fmt.Sprintf("/rooms/%v/metadata", url.PathEscape(room)),
+		capabilityBody{capMetadata, p})
+	return m, nil
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMetadataNewestWins(t *testing.T) {
+	registry := NewMemoryRegistry()
+	a := newTestServer(t, registry)
+	b := newTestServer(t, registry)
+	trust(t, a, b)
+
+	now := time.Now().UTC()
+	for _, c := range []struct {
+		topic   string
+		updated time.Time
+		changed bool
+	}{
+		{"first", now.Add(-time.Minute), true},
+		{"newer", now, true},
+		{"older", now.Add(-time.Second), false},
+	} {
+		p, err := a.signPayload(RoomMetadata{
+			Room:      "test",
+			Topic:     c.topic,
+			Created:   now.Add(-time.Minute),
+			Updated:   c.updated,
+			UpdatedBy: a.id,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, changed, err := b.acceptMetadata("test", p); err != nil || changed != c.changed {
+			t.Errorf("topic %v: expected changed to be %v, got %v (error %v)", c.topic, c.changed, changed, err)
+		}
+	}
+
+	m, _, err := b.getMetadata("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m == nil || m.Topic != "newer" {
+		t.Errorf("expected the newest topic to win, got %+v", m)
+	}
+
+	p, err := a.signPayload(RoomMetadata{Room: "test", Topic: string(make([]byte, maxTopicLength+1)), UpdatedBy: a.id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.acceptMetadata("test", p); err == nil {
+		t.Error("accepted metadata with a topic which is too long")
+	}
+}
+
+func TestFutureMetadata(t *testing.T) {
+	registry := NewMemoryRegistry()
+	a := newTestServer(t, registry)
+	b := newTestServer(t, registry)
+	trust(t, a, b)
+
+	now := time.Now().UTC()
+	for _, c := range []struct {
+		updated time.Time
+		accept  bool
+	}{
+		{now.Add(time.Hour), false},
+		{now.Add(maxMetadataSkew / 2), true},
+	} {
+		p, err := a.signPayload(RoomMetadata{
+			Room:      "test",
+			Topic:     "topic",
+			Created:   now,
+			Updated:   c.updated,
+			UpdatedBy: a.id,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := b.acceptMetadata("test", p); (err == nil) != c.accept {
+			t.Errorf("metadata updated at %v: expected accepted to be %v, got error %v", c.updated, c.accept, err)
+		}
+	}
+}
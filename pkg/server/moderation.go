@@ -0,0 +1,446 @@
+package server
+
+import (
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxKickAge is how old a kick event can be before it is ignored (to prevent replays)
+const maxKickAge = 5 * time.Minute
+
+// kickSeenExpiry is how long the IDs of applied kicks are remembered for (longer than kicks are valid, so a replayed
+// kick is always caught)
+const kickSeenExpiry = 2 * maxKickAge
+
+var errNotAdmin = errors.New("user is not an admin of this room")
+var errNotCreator = errors.New("only the room's creator can create its manifest")
+
+// errKickSeen means a kick has already been applied (e.g. it was replayed or received via several peers)
+var errKickSeen = errors.New("kick has already been applied")
+
+// RoomManifest describes who has authority over a room and who is banned from it
+type RoomManifest struct {
+	Room string `json:"room"`
+	// Version increases with every change to the manifest
+	Version int         `json:"version"`
+	Owner   uuid.UUID   `json:"owner"`
+	Admins  []uuid.UUID `json:"admins"`
+	Banned  []uuid.UUID `json:"banned"`
+	// Signer is the owner or admin who produced this version
+	Signer uuid.UUID `json:"signer"`
+}
+
+// KickEvent removes a user from a room
+type KickEvent struct {
+	// ID distinguishes kicks, so that each is only applied once
+	ID     uuid.UUID `json:"id"`
+	Room   string    `json:"room"`
+	Target uuid.UUID `json:"target"`
+	Signer uuid.UUID `json:"signer"`
+	Time   time.Time `json:"time"`
+}
+
+// signedPayload is a JSON document and the signature of its author, as distributed between peers
+type signedPayload struct {
+	Payload   []byte `json:"payload"`
+	Signature []byte `json:"signature"`
+}
+
+func containsUUID(ids []uuid.UUID, id uuid.UUID) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m RoomManifest) isAdmin(id uuid.UUID) bool {
+	return id == m.Owner || containsUUID(m.Admins, id)
+}
+
+func (m RoomManifest) isBanned(id uuid.UUID) bool {
+	return containsUUID(m.Banned, id)
+}
+
+// canRemove checks if `signer` is allowed to kick or ban `target` from the room
+func (m RoomManifest) canRemove(signer, target uuid.UUID) error {
+	if !m.isAdmin(signer) {
+		return errNotAdmin
+	}
+	if m.isAdmin(target) && signer != m.Owner {
+		return errors.New("only the owner can remove admins")
+	}
+
+	return nil
+}
+
+// seenCache remembers IDs which have recently been seen
+type seenCache struct {
+	lock   sync.Mutex
+	expiry time.Duration
+	seen   map[uuid.UUID]time.Time
+}
+
+func newSeenCache(expiry time.Duration) *seenCache {
+	return &seenCache{
+		expiry: expiry,
+		seen:   make(map[uuid.UUID]time.Time),
+	}
+}
+
+// markSeen records that an ID has been seen, returning false if it already had been
+func (c *seenCache) markSeen(id uuid.UUID) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	for i, t := range c.seen {
+		if now.Sub(t) > c.expiry {
+			delete(c.seen, i)
+		}
+	}
+
+	if _, ok := c.seen[id]; ok {
+		return false
+	}
+
+	c.seen[id] = now
+	return true
+}
+
+// getRoomCreator retrieves the user who created a room, returning uuid.Nil if it isn't known
+func (s *Server) getRoomCreator(room string) (uuid.UUID, error) {
+	var id uuid.UUID
+	if err := s.stmts.getRoomCreator.QueryRow(room).Scan(&id); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return id, fmt.Errorf("failed to retrieve room creator from database: %w", err)
+	}
+
+	return id, nil
+}
+
+// setRoomCreator records the user who created a room (unless it is already known)
+func (s *Server) setRoomCreator(room string, id uuid.UUID) error {
+	if _, err := s.stmts.setRoomCreator.Exec(room, id[:]); err != nil {
+		return fmt.Errorf("failed to store room creator: %w", err)
+	}
+
+	return nil
+}
+
+// certFor retrieves the certificate of a user (including this one)
+func (s *Server) certFor(id uuid.UUID) (*x509.Certificate, error) {
+	if id == s.id {
+		return s.cert.Leaf, nil
+	}
+
+	u, err := s.getUser(id.String())
+	if err != nil {
+		return nil, fmt.Errorf("unknown user %v: %w", id, err)
+	}
+	return u.Cert, nil
+}
+
+// signPayload encodes and signs a value
+func (s *Server) signPayload(v interface{}) (signedPayload, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return signedPayload{}, fmt.Errorf("failed to encode payload: %w", err)
+	}
+
+	sig, err := s.sign(data)
+	if err != nil {
+		return signedPayload{}, err
+	}
+	return signedPayload{data, sig}, nil
+}
+
+// openPayload decodes a signed value, checking that it was signed by the user returned by `signer`
+func (s *Server) openPayload(p signedPayload, v interface{}, signer func() uuid.UUID) error {
+	if err := json.Unmarshal(p.Payload, v); err != nil {
+		return fmt.Errorf("failed to parse payload: %w", err)
+	}
+
+	cert, err := s.certFor(signer())
+	if err != nil {
+		return err
+	}
+	if err := checkSignature(cert, p.Payload, p.Signature); err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+	return nil
+}
+
+// getManifest retrieves a room's manifest, returning nil if the room has none
+func (s *Server) getManifest(room string) (*RoomManifest, signedPayload, error) {
+	var p signedPayload
+	if err := s.stmts.getRoomManifest.QueryRow(room).Scan(&p.Payload, &p.Signature); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, p, nil
+		}
+
+		return nil, p, fmt.Errorf("failed to retrieve room manifest from database: %w", err)
+	}
+
+	var m RoomManifest
+	if err := json.Unmarshal(p.Payload, &m); err != nil {
+		return nil, p, fmt.Errorf("failed to parse stored room manifest: %w", err)
+	}
+	return &m, p, nil
+}
+
+// acceptManifest stores a manifest received from a peer if it is a valid successor to the current one, returning
+// whether or not it was newer
+func (s *Server) acceptManifest(room string, p signedPayload) (RoomManifest, bool, error) {
+	var m RoomManifest
+	if err := s.openPayload(p, &m, func() uuid.UUID { return m.Signer }); err != nil {
+		return m, false, err
+	}
+	if m.Room != room {
+		return m, false, errors.New("manifest is for a different room")
+	}
+	if hasDuplicateUUIDs(m.Admins) || hasDuplicateUUIDs(m.Banned) {
+		return m, false, errors.New("manifest lists a user more than once")
+	}
+
+	// ownership is bound to the room's creator, so a manifest naming anyone else as the owner conflicts with the
+	// legitimate one
+	creator, err := s.getRoomCreator(room)
+	if err != nil {
+		return m, false, err
+	}
+	if creator != uuid.Nil && m.Owner != creator {
+		return m, false, errors.New("manifest is not owned by the room's creator")
+	}
+
+	old, _, err := s.getManifest(room)
+	if err != nil {
+		return m, false, err
+	}
+
+	if old == nil {
+		// if the creator isn't known, the first manifest seen for a room is trusted (as long as the owner produced
+		// it) and its owner becomes the creator
+		if m.Signer != m.Owner {
+			return m, false, errors.New("initial manifest must be signed by the owner")
+		}
+	} else {
+		if m.Version <= old.Version {
+			return *old, false, nil
+		}
+		if !old.isAdmin(m.Signer) {
+			return m, false, errNotAdmin
+		}
+		if m.Signer != old.Owner && (m.Owner != old.Owner || !sameUUIDs(m.Admins, old.Admins)) {
+			return m, false, errors.New("only the owner can change the owner or admins")
+		}
+	}
+
+	if err := s.setRoomCreator(room, m.Owner); err != nil {
+		return m, false, err
+	}
+	if _, err := s.stmts.setRoomManifest.Exec(room, p.Payload, p.Signature); err != nil {
+		return m, false, fmt.Errorf("failed to store room manifest: %w", err)
+	}
+	return m, true, nil
+}
+
+// hasDuplicateUUIDs checks if any UUID appears in a list more than once
+func hasDuplicateUUIDs(ids []uuid.UUID) bool {
+	for i, id := range ids {
+		if containsUUID(ids[i+1:], id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sameUUIDs checks if two lists contain the same set of UUIDs (ignoring order and duplicates)
+func sameUUIDs(a, b []uuid.UUID) bool {
+	for _, id := range a {
+		if !containsUUID(b, id) {
+			return false
+		}
+	}
+	for _, id := range b {
+		if !containsUUID(a, id) {
+			return false
+		}
+	}
+	return true
+}
+
+// updateManifest applies a change to a room's manifest (creating it with this user as the owner if they created the
+// room), signs it and distributes it to the room's members
+func (s *Server) updateManifest(room string, update func(m *RoomManifest) error) (RoomManifest, error) {
+	old, _, err := s.getManifest(room)
+	if err != nil {
+		return RoomManifest{}, err
+	}
+	if old == nil {
+		creator, err := s.getRoomCreator(room)
+		if err != nil {
+			return RoomManifest{}, err
+		}
+		if creator != s.id {
+			return RoomManifest{}, errNotCreator
+		}
+	}
+
+	m := RoomManifest{
+		Room:   room,
+		Owner:  s.id,
+		Admins: []uuid.UUID{},
+		Banned: []uuid.UUID{},
+	}
+	if old != nil {
+		if !old.isAdmin(s.id) {
+			return *old, errNotAdmin
+		}
+
+		m = *old
+	}
+
+	if err := update(&m); err != nil {
+		return m, err
+	}
+	m.Version++
+	m.Signer = s.id
+
+	p, err := s.signPayload(m)
+	if err != nil {
+		return m, err
+	}
+	if _, err := s.stmts.setRoomManifest.Exec(room, p.Payload, p.Signature); err != nil {
+		return m, fmt.Errorf("failed to store room manifest: %w", err)
+	}
+
+	s.publishJSONEvent(streamRooms, eventManifest, m)
+	s.sendToRoom(room, http.MethodPut, fmt.Sprintf("/rooms/%v/manifest", url.PathEscape(room)), p)
+	return m, nil
+}
+
+// kick signs and distributes an event removing a user from a room
+func (s *Server) kick(room string, target uuid.UUID) error {
+	m, _, err := s.getManifest(room)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return errNotAdmin
+	}
+	if err := m.canRemove(s.id, target); err != nil {
+		return err
+	}
+
+	p, err := s.signPayload(KickEvent{
+		ID:     uuid.New(),
+		Room:   room,
+		Target: target,
+		Signer: s.id,
+		Time:   time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	s.sendToRoom(room, http.MethodPost, fmt.Sprintf("/rooms/%v/kick", url.PathEscape(room)), p)
+	return nil
+}
+
+// acceptKick checks a kick event received from a peer against the room's manifest, returning errKickSeen if it has
+// already been applied
+func (s *Server) acceptKick(room string, p signedPayload) (KickEvent, error) {
+	var k KickEvent
+	if err := s.openPayload(p, &k, func() uuid.UUID { return k.Signer }); err != nil {
+		return k, err
+	}
+	if k.Room != room {
+		return k, errors.New("kick is for a different room")
+	}
+	if age := time.Since(k.Time); age > maxKickAge || age < -maxKickAge {
+		return k, errors.New("kick event is too old or too far in the future")
+	}
+
+	m, _, err := s.getManifest(room)
+	if err != nil {
+		return k, err
+	}
+	if m == nil {
+		return k, errNotAdmin
+	}
+	if err := m.canRemove(k.Signer, k.Target); err != nil {
+		return k, err
+	}
+
+	// kick IDs are remembered for longer than kicks are valid, so a replayed kick is always caught
+	if !s.kicks.markSeen(k.ID) {
+		return k, errKickSeen
+	}
+	return k, nil
+}
+
+// isBanned checks if a user is banned from a room
+func (s *Server) isBanned(room string, id uuid.UUID) (bool, error) {
+	m, _, err := s.getManifest(room)
+	if err != nil || m == nil {
+		return false, err
+	}
+
+	return m.isBanned(id), nil
+}
+
+// pushRoomState sends a room's manifest and metadata to members as they join until `events` is closed
+func (s *Server) pushRoomState(events <-chan DiscoveryEvent) {
+	for e := range events {
+		if e.Type != EventMemberJoined || !s.discovery.IsMember(e.Room) {
+			continue
+		}
+
+		l := log.WithField("room", e.Room)
+		manifest, mp, err := s.getManifest(e.Room)
+		if err != nil {
+			l.WithError(err).Error("Failed to retrieve room manifest")
+			continue
+		}
+		metadata, dp, err := s.getMetadata(e.Room)
+		if err != nil {
+			l.WithError(err).Error("Failed to retrieve room metadata")
+			continue
+		}
+
+		go func(e DiscoveryEvent) {
+			l := log.WithFields(log.Fields{
+				"id":   e.Member.UUID.String(),
+				"room": e.Room,
+			})
+
+			// the manifest goes first, since it decides who may change the metadata
+			if manifest != nil {
+				path := fmt.Sprintf("/rooms/%v/manifest", url.PathEscape(e.Room))
+				if err := s.sendToMember(e.Room, e.Member, http.MethodPut, path, mp); err != nil {
+					l.WithError(err).Debug("Failed to send room manifest to new member")
+				}
+			}
+			if metadata != nil {
+				path := fmt.Sprintf("/rooms/%v/metadata", url.PathEscape(e.Room))
+				err := s.sendToMember(e.Room, e.Member, http.MethodPut, path, capabilityBody{capMetadata, dp})
+				if err != nil {
+					l.WithError(err).Debug("Failed to send room metadata to new member")
+				}
+			}
+		}(e)
+	}
+}
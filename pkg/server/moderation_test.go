@@ -0,0 +1,271 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestManifestModeration(t *testing.T) {
+	registry := NewMemoryRegistry()
+	a := newTestServer(t, registry)
+	b := newTestServer(t, registry)
+	trust(t, a, b)
+
+	if err := a.setRoomCreator("test", a.id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.updateManifest("test", func(m *RoomManifest) error {
+		m.Admins = append(m.Admins, b.id)
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to create manifest: %v", err)
+	}
+	_, p, err := a.getManifest("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, changed, err := b.acceptManifest("test", p); err != nil || !changed {
+		t.Fatalf("failed to accept manifest: %v", err)
+	}
+	if _, changed, err := b.acceptManifest("test", p); err != nil || changed {
+		t.Errorf("expected the same manifest to be ignored, got changed %v and error %v", changed, err)
+	}
+
+	// admins can ban users
+	banned := uuid.New()
+	if _, err := b.updateManifest("test", func(m *RoomManifest) error {
+		m.Banned = append(m.Banned, banned)
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to update manifest: %v", err)
+	}
+	_, p, err = b.getManifest("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, changed, err := a.acceptManifest("test", p); err != nil || !changed {
+		t.Fatalf("failed to accept manifest from admin: %v", err)
+	}
+	if isBanned, err := a.isBanned("test", banned); err != nil || !isBanned {
+		t.Errorf("expected %v to be banned", banned)
+	}
+
+	// but only the owner can change the admins
+	if _, err := b.updateManifest("test", func(m *RoomManifest) error {
+		m.Admins = append(m.Admins, uuid.New())
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to update manifest: %v", err)
+	}
+	_, p, err = b.getManifest("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.acceptManifest("test", p); err == nil {
+		t.Error("accepted a manifest from an admin changing the admins")
+	}
+
+	now := time.Now().UTC()
+	for _, c := range []struct {
+		kick  KickEvent
+		valid bool
+	}{
+		{KickEvent{ID: uuid.New(), Room: "test", Target: uuid.New(), Signer: b.id, Time: now}, true},
+		{KickEvent{ID: uuid.New(), Room: "test", Target: a.id, Signer: b.id, Time: now}, false},
+		{KickEvent{ID: uuid.New(), Room: "other", Target: uuid.New(), Signer: b.id, Time: now}, false},
+		{KickEvent{ID: uuid.New(), Room: "test", Target: uuid.New(), Signer: b.id, Time: now.Add(-time.Hour)}, false},
+	} {
+		p, err := b.signPayload(c.kick)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := a.acceptKick("test", p); (err == nil) != c.valid {
+			t.Errorf("kick %+v: expected valid to be %v, got error %v", c.kick, c.valid, err)
+		}
+	}
+}
+
+func TestManifestOwnership(t *testing.T) {
+	registry := NewMemoryRegistry()
+	a := newTestServer(t, registry)
+	b := newTestServer(t, registry)
+	trust(t, a, b)
+
+	if err := a.setRoomCreator("test", a.id); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.updateManifest("test", func(*RoomManifest) error { return nil }); !errors.Is(err, errNotCreator) {
+		t.Errorf("expected only the creator to be able to create a manifest, got %v", err)
+	}
+
+	p, err := b.signPayload(RoomManifest{
+		Room:    "test",
+		Version: 1,
+		Owner:   b.id,
+		Admins:  []uuid.UUID{},
+		Banned:  []uuid.UUID{},
+		Signer:  b.id,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.acceptManifest("test", p); err == nil {
+		t.Error("accepted a manifest not owned by the room's creator")
+	}
+
+	if _, err := a.updateManifest("test", func(*RoomManifest) error { return nil }); err != nil {
+		t.Fatalf("failed to create manifest: %v", err)
+	}
+	_, p, err = a.getManifest("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, changed, err := b.acceptManifest("test", p); err != nil || !changed {
+		t.Fatalf("failed to accept the creator's manifest: %v", err)
+	}
+
+	// the first manifest b accepted binds the room to its owner
+	creator, err := b.getRoomCreator("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creator != a.id {
+		t.Errorf("expected creator to be %v, got %v", a.id, creator)
+	}
+}
+
+func TestKickReplay(t *testing.T) {
+	registry := NewMemoryRegistry()
+	a := newTestServer(t, registry)
+	b := newTestServer(t, registry)
+	trust(t, a, b)
+
+	if err := a.setRoomCreator("test", a.id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.updateManifest("test", func(*RoomManifest) error { return nil }); err != nil {
+		t.Fatalf("failed to create manifest: %v", err)
+	}
+	_, p, err := a.getManifest("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.acceptManifest("test", p); err != nil {
+		t.Fatalf("failed to accept manifest: %v", err)
+	}
+
+	p, err = a.signPayload(KickEvent{
+		ID:     uuid.New(),
+		Room:   "test",
+		Target: uuid.New(),
+		Signer: a.id,
+		Time:   time.Now().UTC(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.acceptKick("test", p); err != nil {
+		t.Fatalf("failed to accept kick: %v", err)
+	}
+	if _, err := b.acceptKick("test", p); !errors.Is(err, errKickSeen) {
+		t.Errorf("expected a replayed kick to be seen, got %v", err)
+	}
+}
+
+func TestManifestDuplicateAdmins(t *testing.T) {
+	registry := NewMemoryRegistry()
+	a := newTestServer(t, registry)
+	b := newTestServer(t, registry)
+	c := newTestServer(t, registry)
+	trust(t, a, b)
+	trust(t, a, c)
+	trust(t, b, c)
+
+	if err := a.setRoomCreator("test", a.id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.updateManifest("test", func(m *RoomManifest) error {
+		m.Admins = []uuid.UUID{b.id, c.id}
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to create manifest: %v", err)
+	}
+	old, p, err := a.getManifest("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.acceptManifest("test", p); err != nil {
+		t.Fatalf("failed to accept manifest: %v", err)
+	}
+
+	// b (an admin, but not the owner) tries to demote c by replacing them with a duplicate of itself
+	for _, admins := range [][]uuid.UUID{{b.id, b.id}, {b.id}} {
+		m := *old
+		m.Version++
+		m.Admins = admins
+		m.Signer = b.id
+		p, err := b.signPayload(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.acceptManifest("test", p); err == nil {
+			t.Errorf("accepted a manifest from an admin changing the admins to %v", admins)
+		}
+	}
+
+	m, _, err := c.getManifest("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.isAdmin(c.id) {
+		t.Error("admin was demoted by another admin")
+	}
+}
+
+func TestRoomCreator(t *testing.T) {
+	registry := NewMemoryRegistry()
+	a := newTestServer(t, registry)
+	b := newTestServer(t, registry)
+	trust(t, a, b)
+
+	uiRequest(t, a, http.MethodPut, "/api/rooms/test", "")
+	// joining a room (even one which looks empty) doesn't make b its creator
+	uiRequest(t, b, http.MethodPost, "/api/rooms/test", "")
+	creator, err := b.getRoomCreator("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creator != uuid.Nil {
+		t.Errorf("expected creator to be unknown after joining, got %v", creator)
+	}
+
+	eventually(t, "members to see each other join", func() bool {
+		return inRoom(a, "test", b) && inRoom(b, "test", a)
+	})
+	if _, err := b.createRoom("other"); err != nil {
+		t.Fatalf("failed to create room: %v", err)
+	}
+	eventually(t, "member to be seen creating a room", func() bool {
+		return inRoom(a, "other", b)
+	})
+	if _, err := a.createRoom("other"); !errors.Is(err, errRoomExists) {
+		t.Errorf("expected creating a room with members to fail, got %v", err)
+	}
+
+	if _, err := a.updateManifest("test", func(*RoomManifest) error { return nil }); err != nil {
+		t.Fatalf("failed to create manifest: %v", err)
+	}
+	eventually(t, "manifest to be delivered", func() bool {
+		m, _, err := b.getManifest("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return m != nil && m.Owner == a.id
+	})
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// PresenceStatus represents a user's availability
+type PresenceStatus string
+
+// Possible presence statuses
+const (
+	StatusOnline       PresenceStatus = "online"
+	StatusAway         PresenceStatus = "away"
+	StatusDoNotDisturb PresenceStatus = "dnd"
+)
+
+const maxStatusText = 128
+const typingInterval = 3 * time.Second
+
+// Presence represents a user's availability and custom status text
+type Presence struct {
+	Status PresenceStatus `json:"status"`
+	Text   string         `json:"text,omitempty"`
+}
+
+func (p Presence) validate() error {
+	switch p.Status {
+	case StatusOnline, StatusAway, StatusDoNotDisturb:
+	default:
+		return fmt.Errorf("unknown status %v", p.Status)
+	}
+
+	if len(p.Text) > maxStatusText {
+		return fmt.Errorf("status text must be at most %v bytes", maxStatusText)
+	}
+	return nil
+}
+
+func (p Presence) txts() []string {
+	txts := []string{"status=" + string(p.Status)}
+	if p.Text != "" {
+		txts = append(txts, "statustext="+p.Text)
+	}
+
+	return txts
+}
+
+func (s *Server) loadPresence() (Presence, error) {
+	p := Presence{Status: StatusOnline}
+
+	data, err := s.getSetting("presence")
+	if err != nil || data == nil {
+		return p, err
+	}
+
+	if err := json.Unmarshal(data, &p); err != nil {
+		return p, fmt.Errorf("failed to parse stored presence: %w", err)
+	}
+	return p, nil
+}
+
+func (s *Server) savePresence(p Presence) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("failed to encode presence: %w", err)
+	}
+
+	return s.setSetting("presence", data)
+}
+
+// rateLimiter allows at most one event per key in a given interval
+type rateLimiter struct {
+	interval time.Duration
+
+	lock sync.Mutex
+	last map[string]time.Time
+}
+
+func newRateLimiter(interval time.Duration) *rateLimiter {
+	return &rateLimiter{
+		interval: interval,
+		last:     make(map[string]time.Time),
+	}
+}
+
+func (l *rateLimiter) allow(key string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	if t, ok := l.last[key]; ok && now.Sub(t) < l.interval {
+		return false
+	}
+
+	// forget about keys which would be allowed anyway
+	for k, t := range l.last {
+		if now.Sub(t) >= l.interval {
+			delete(l.last, k)
+		}
+	}
+
+	l.last[key] = now
+	return true
+}
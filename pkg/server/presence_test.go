@@ -0,0 +1,50 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPresence(t *testing.T) {
+	for _, c := range []struct {
+		presence Presence
+		valid    bool
+	}{
+		{Presence{Status: StatusOnline}, true},
+		{Presence{Status: StatusDoNotDisturb, Text: "busy"}, true},
+		{Presence{Status: "asleep"}, false},
+		{Presence{Status: StatusAway, Text: strings.Repeat("x", maxStatusText+1)}, false},
+	} {
+		if err := c.presence.validate(); (err == nil) != c.valid {
+			t.Errorf("%+v: expected valid to be %v, got error %v", c.presence, c.valid, err)
+		}
+	}
+
+	s := newTestServer(t, NewMemoryRegistry())
+	p, err := s.loadPresence()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != StatusOnline {
+		t.Errorf("expected default status to be online, got %v", p.Status)
+	}
+	if err := s.savePresence(Presence{Status: StatusAway, Text: "lunch"}); err != nil {
+		t.Fatal(err)
+	}
+	if p, err = s.loadPresence(); err != nil || p.Status != StatusAway || p.Text != "lunch" {
+		t.Errorf("expected saved presence to be loaded, got %+v (error %v)", p, err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(typingInterval)
+	if !l.allow("a") {
+		t.Error("first event was not allowed")
+	}
+	if l.allow("a") {
+		t.Error("second event within the interval was allowed")
+	}
+	if !l.allow("b") {
+		t.Error("event for a different key was not allowed")
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+const roomSecretSize = 32
+
+// roomTagSize is the number of bytes of the HMAC advertised for a private room
+const roomTagSize = 16
+
+// roomTag derives the tag advertised for a private room, which only peers who know the secret can recognise
+func roomTag(room string, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(room))
+
+	return hex.EncodeToString(mac.Sum(nil)[:roomTagSize])
+}
+
+func generateRoomSecret() ([]byte, error) {
+	secret := make([]byte, roomSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate room secret: %w", err)
+	}
+
+	return secret, nil
+}
+
+// getRoomSecret retrieves the secret for a private room, returning nil if the room is public
+func (s *Server) getRoomSecret(room string) ([]byte, error) {
+	var secret []byte
+	if err := s.stmts.getRoomSecret.QueryRow(room).Scan(&secret); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to retrieve room secret from database: %w", err)
+	}
+
+	return secret, nil
+}
+
+// setRoomSecret makes a room private (or public if `secret` is nil)
+func (s *Server) setRoomSecret(room string, secret []byte) error {
+	stmt, args := s.stmts.setRoomSecret, []interface{}{room, secret}
+	if secret == nil {
+		stmt, args = s.stmts.removeRoomSecret, []interface{}{room}
+	}
+	if _, err := stmt.Exec(args...); err != nil {
+		return fmt.Errorf("failed to update room secret in database: %w", err)
+	}
+
+	s.auth.forget(room)
+	s.discovery.SetRoomSecret(room, secret)
+	return nil
+}
+
+// loadRoomSecrets passes the secrets of all private rooms to discovery
+func (s *Server) loadRoomSecrets() error {
+	rows, err := s.stmts.roomSecrets.Query()
+	if err != nil {
+		return fmt.Errorf("failed to query database for room secrets: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			room   string
+			secret []byte
+		)
+		if err := rows.Scan(&room, &secret); err != nil {
+			return fmt.Errorf("failed to read room secret from query result: %w", err)
+		}
+
+		s.discovery.SetRoomSecret(room, secret)
+	}
+
+	return rows.Err()
+}
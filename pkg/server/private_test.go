@@ -0,0 +1,40 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestPrivateRooms(t *testing.T) {
+	secret, err := generateRoomSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := generateRoomSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := newStaticDiscovery()
+	member, stranger := RoomMember{UUID: uuid.New()}, RoomMember{UUID: uuid.New()}
+	d.updateMember(member, roomAdvert{Private: []string{roomTag("secret", secret)}})
+	// a public room with the same name as a private one is a different room
+	d.updateMember(stranger, roomAdvert{Rooms: []string{"secret"}, Private: []string{roomTag("secret", other)}})
+	if _, ok := d.GetRooms()["secret"]; !ok {
+		t.Fatal("expected public room to be visible before the secret is known")
+	}
+
+	// advertisements are re-read once the secret is known
+	d.setRoomSecret("secret", secret)
+	members := d.GetRooms()["secret"]
+	if len(members) != 1 || members[0].UUID != member.UUID {
+		t.Errorf("expected only %v in private room, got %+v", member.UUID, members)
+	}
+
+	d.setRoomSecret("secret", nil)
+	members = d.GetRooms()["secret"]
+	if len(members) != 1 || members[0].UUID != stranger.UUID {
+		t.Errorf("expected only %v in public room, got %+v", stranger.UUID, members)
+	}
+}
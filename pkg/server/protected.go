@@ -0,0 +1,298 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const nonceSize = 32
+const challengeValidity = 30 * time.Second
+
+// proofValidity is how long a peer's proof of knowing a room's secret is trusted before they must prove it again
+const proofValidity = time.Hour
+
+const defaultInviteValidity = 24 * time.Hour
+
+// roomProof computes the proof that `prover` knows a room's secret, in response to a nonce chosen by `verifier`
+func roomProof(secret []byte, room string, prover, verifier uuid.UUID, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(room))
+	mac.Write(prover[:])
+	mac.Write(verifier[:])
+	mac.Write(nonce)
+
+	return mac.Sum(nil)
+}
+
+func generateNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return nonce, nil
+}
+
+type challenge struct {
+	peer    uuid.UUID
+	room    string
+	expires time.Time
+}
+
+// roomAuth keeps track of outstanding challenges and which peers have proven membership of protected rooms
+type roomAuth struct {
+	lock sync.Mutex
+	// challenges are keyed by nonce, so that a peer can answer several at once
+	challenges map[string]challenge
+	proven     map[string]time.Time
+}
+
+func newRoomAuth() *roomAuth {
+	return &roomAuth{
+		challenges: make(map[string]challenge),
+		proven:     make(map[string]time.Time),
+	}
+}
+
+func roomAuthKey(id uuid.UUID, room string) string {
+	return id.String() + "/" + room
+}
+
+// challenge creates a nonce for a peer to prove its membership of a room with
+func (a *roomAuth) challenge(id uuid.UUID, room string) ([]byte, error) {
+	nonce, err := generateNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	now := time.Now()
+	for k, c := range a.challenges {
+		if now.After(c.expires) {
+			delete(a.challenges, k)
+		}
+	}
+
+	a.challenges[string(nonce)] = challenge{id, room, now.Add(challengeValidity)}
+	return nonce, nil
+}
+
+// answerChallenge finds (and forgets) an outstanding challenge of a peer for a room whose nonce is accepted by `check`
+func (a *roomAuth) answerChallenge(id uuid.UUID, room string, check func(nonce []byte) bool) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	now := time.Now()
+	for nonce, c := range a.challenges {
+		if c.peer != id || c.room != room || now.After(c.expires) {
+			continue
+		}
+
+		if check([]byte(nonce)) {
+			delete(a.challenges, nonce)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *roomAuth) prove(id uuid.UUID, room string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.proven[roomAuthKey(id, room)] = time.Now().Add(proofValidity)
+}
+
+func (a *roomAuth) isProven(id uuid.UUID, room string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	key := roomAuthKey(id, room)
+	expires, ok := a.proven[key]
+	if ok && time.Now().After(expires) {
+		delete(a.proven, key)
+		return false
+	}
+
+	return ok
+}
+
+// forget discards all proofs for a room (e.g. when its secret changes)
+func (a *roomAuth) forget(room string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	suffix := "/" + room
+	for k := range a.proven {
+		if strings.HasSuffix(k, suffix) {
+			delete(a.proven, k)
+		}
+	}
+}
+
+// roomAccess checks that this user is in a room, that the peer making a request has proven membership if the room is
+// protected and that they are not banned, responding with an error if not
+func (s *Server) roomAccess(w http.ResponseWriter, room string, u User) bool {
+	if !s.discovery.IsMember(room) {
+		JSONErrResponse(w, errors.New("user is not a member of this room"), http.StatusBadRequest)
+		return false
+	}
+
+	secret, err := s.getRoomSecret(room)
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return false
+	}
+	if secret != nil && !s.auth.isProven(u.UUID, room) {
+		JSONErrResponse(w, errors.New("peer has not proven membership of this room"), http.StatusForbidden)
+		return false
+	}
+
+	banned, err := s.isBanned(room, u.UUID)
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return false
+	}
+	if banned {
+		JSONErrResponse(w, errors.New("user is banned from this room"), http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// authenticate performs mutual challenge-response with a peer to prove that both know a protected room's secret
+func (s *Server) authenticate(m RoomMember, room string, secret []byte) error {
+	nonce, err := generateNonce()
+	if err != nil {
+		return err
+	}
+
+	id := m.UUID
+	caps := s.peerCapabilities(m)
+	roomPath := fmt.Sprintf("/rooms/%v", url.PathEscape(room))
+
+	var res apiResChallenge
+	if err := s.peerRequest(m, caps, http.MethodPost, roomPath+"/challenge", apiReqChallenge{Nonce: nonce},
+		&res); err != nil {
+		return fmt.Errorf("failed to challenge peer: %w", err)
+	}
+	if !hmac.Equal(res.Proof, roomProof(secret, room, id, s.id, nonce)) {
+		return errors.New("peer failed to prove membership of room")
+	}
+
+	if err := s.peerRequest(m, caps, http.MethodPost, roomPath+"/prove", apiReqProve{
+		Proof: roomProof(secret, room, s.id, id, res.Nonce),
+	}, nil); err != nil {
+		return fmt.Errorf("failed to prove membership to peer: %w", err)
+	}
+
+	s.auth.prove(id, room)
+	return nil
+}
+
+// Invite is a token allowing a user to join a protected room, signed by an existing member
+type Invite struct {
+	Room    string    `json:"room"`
+	Secret  []byte    `json:"secret"`
+	Inviter uuid.UUID `json:"inviter"`
+	// Creator is the user who created the room (uuid.Nil if the inviter doesn't know)
+	Creator uuid.UUID `json:"creator"`
+	Expires time.Time `json:"expires"`
+}
+
+// createInvite produces a signed invite token for a protected room
+func (s *Server) createInvite(room string, validFor time.Duration) (string, error) {
+	secret, err := s.getRoomSecret(room)
+	if err != nil {
+		return "", err
+	}
+	if secret == nil {
+		return "", errors.New("room is not protected")
+	}
+
+	creator, err := s.getRoomCreator(room)
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(Invite{
+		Room:    room,
+		Secret:  secret,
+		Inviter: s.id,
+		Creator: creator,
+		Expires: time.Now().Add(validFor).UTC(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode invite: %w", err)
+	}
+
+	sig, err := s.sign(payload)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// parseInvite checks that an invite token was signed by a verified user and has not expired
+func (s *Server) parseInvite(token string) (Invite, error) {
+	var invite Invite
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return invite, errors.New("malformed invite token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return invite, fmt.Errorf("failed to decode invite: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return invite, fmt.Errorf("failed to decode invite signature: %w", err)
+	}
+
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&invite); err != nil {
+		return invite, fmt.Errorf("failed to parse invite: %w", err)
+	}
+
+	inviter, err := s.getUser(invite.Inviter.String())
+	if err != nil {
+		return invite, fmt.Errorf("unknown inviter: %w", err)
+	}
+	if !inviter.Verified {
+		return invite, errors.New("inviter has not been verified")
+	}
+	if err := checkSignature(inviter.Cert, payload, sig); err != nil {
+		return invite, fmt.Errorf("invalid invite signature: %w", err)
+	}
+
+	if time.Now().After(invite.Expires) {
+		return invite, errors.New("invite has expired")
+	}
+	if !validRoomName(invite.Room) {
+		return invite, errors.New("invite is for an invalid room name")
+	}
+	if len(invite.Secret) < roomTagSize {
+		return invite, errors.New("invite contains an invalid room secret")
+	}
+	return invite, nil
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestProtectedRoom(t *testing.T) {
+	registry := NewMemoryRegistry()
+	a := newTestServer(t, registry)
+	b := newTestServer(t, registry)
+	trust(t, a, b)
+
+	uiRequest(t, a, http.MethodPost, "/api/rooms/test", "")
+	uiRequest(t, a, http.MethodPut, "/api/rooms/test/secret", "{}")
+
+	if _, err := b.parseInvite("not.valid"); err == nil {
+		t.Error("expected malformed invite to be rejected")
+	}
+	expired, err := a.createInvite("test", -time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create invite: %v", err)
+	}
+	if _, err := b.parseInvite(expired); err == nil {
+		t.Error("expected expired invite to be rejected")
+	}
+
+	token, err := a.createInvite("test", time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create invite: %v", err)
+	}
+	uiRequest(t, b, http.MethodPost, "/api/invites", fmt.Sprintf(`{"token":%q}`, token))
+	eventually(t, "members to see each other join", func() bool {
+		return inRoom(a, "test", b) && inRoom(b, "test", a)
+	})
+
+	uiRequest(t, a, http.MethodPost, "/api/rooms/test/message", `{"username":"a","content":"hello"}`)
+	eventually(t, "message to be delivered", func() bool {
+		history, err := b.getRoomHistory("test")
+		if err != nil {
+			t.Fatalf("failed to retrieve history: %v", err)
+		}
+
+		return len(history) == 1 && history[0].Content == "hello"
+	})
+	if !a.auth.isProven(b.id, "test") || !b.auth.isProven(a.id, "test") {
+		t.Error("expected both members to have proven membership to each other")
+	}
+}
+
+func TestConcurrentChallenges(t *testing.T) {
+	a := newRoomAuth()
+	peer := uuid.New()
+
+	first, err := a.challenge(peer, "room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := a.challenge(peer, "room")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	answer := func(nonce []byte) bool {
+		return a.answerChallenge(peer, "room", func(n []byte) bool {
+			return bytes.Equal(n, nonce)
+		})
+	}
+	if !answer(second) || !answer(first) {
+		t.Fatal("failed to answer both outstanding challenges")
+	}
+	if answer(first) {
+		t.Error("challenge was answered twice")
+	}
+
+	third, err := a.challenge(peer, "room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.answerChallenge(uuid.New(), "room", func(n []byte) bool { return bytes.Equal(n, third) }) {
+		t.Error("challenge was answered by a different peer")
+	}
+	if a.answerChallenge(peer, "other", func(n []byte) bool { return bytes.Equal(n, third) }) {
+		t.Error("challenge was answered for a different room")
+	}
+}
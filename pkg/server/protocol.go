@@ -0,0 +1,163 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// protocolVersion is the version of the peer API implemented by this server. Peers which don't advertise a version are
+// treated as version 0, and are sent requests using the original (unversioned) paths and message format.
+const protocolVersion = 1
+
+// capabilityExpiry is how long a peer's capabilities are remembered for
+const capabilityExpiry = 10 * time.Minute
+
+// Optional features of the peer API, which are only used with peers that support them
+const (
+	// capSignedMessages means messages carry their sender's signature and Lamport clock
+	capSignedMessages = "signed-messages"
+	// capRelay means the peer accepts relayed messages (whether it will forward them depends on its settings)
+	capRelay = "relay"
+	// capHistory means the peer can be asked for room history (whether it will share it depends on its settings)
+	capHistory = "history"
+	// capMetadata means the peer accepts room metadata
+	capMetadata = "metadata"
+	// capRendezvous means the peer acts as a rendezvous node
+	capRendezvous = "rendezvous"
+	// capStreams means requests can be made to the peer over a persistent stream (see streams.go)
+	capStreams = "streams"
+)
+
+type apiResCapabilities struct {
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// has checks if a capability is supported
+func (c apiResCapabilities) has(capability string) bool {
+	for _, name := range c.Capabilities {
+		if name == capability {
+			return true
+		}
+	}
+
+	return false
+}
+
+// peerBody is implemented by request bodies which need to be adapted for peers lacking some capabilities, returning
+// false if the request shouldn't be sent to the peer at all
+type peerBody interface {
+	forPeer(caps apiResCapabilities) (interface{}, bool)
+}
+
+// capabilityBody is a request body which is only sent to peers supporting a capability
+type capabilityBody struct {
+	capability string
+	body       interface{}
+}
+
+func (b capabilityBody) forPeer(caps apiResCapabilities) (interface{}, bool) {
+	return b.body, caps.has(b.capability)
+}
+
+// negotiateVersion picks the protocol version to use with a peer advertising `version`
+func negotiateVersion(version int) int {
+	if version > protocolVersion {
+		// newer peers continue to serve older versions
+		return protocolVersion
+	}
+	if version < 0 {
+		return 0
+	}
+
+	return version
+}
+
+// versionedPath returns the path of a peer API endpoint for a given protocol version
+func versionedPath(version int, path string) string {
+	if version == 0 {
+		return path
+	}
+
+	return fmt.Sprintf("/v%v%v", version, path)
+}
+
+type capabilityEntry struct {
+	caps    apiResCapabilities
+	fetched time.Time
+}
+
+// capabilityCache remembers the capabilities of peers
+type capabilityCache struct {
+	lock    sync.Mutex
+	entries map[uuid.UUID]capabilityEntry
+}
+
+func newCapabilityCache() *capabilityCache {
+	return &capabilityCache{
+		entries: make(map[uuid.UUID]capabilityEntry),
+	}
+}
+
+func (c *capabilityCache) get(id uuid.UUID, version int) (apiResCapabilities, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[id]
+	if !ok || e.caps.Version != version || time.Since(e.fetched) > capabilityExpiry {
+		return apiResCapabilities{}, false
+	}
+
+	return e.caps, true
+}
+
+func (c *capabilityCache) set(id uuid.UUID, caps apiResCapabilities) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries[id] = capabilityEntry{caps, time.Now()}
+}
+
+// capabilities lists the capabilities of this server
+func (s *Server) capabilities() apiResCapabilities {
+	caps := apiResCapabilities{
+		Version:      protocolVersion,
+		Capabilities: []string{capSignedMessages, capRelay, capHistory, capMetadata, capStreams},
+	}
+	if s.rendezvous != nil {
+		caps.Capabilities = append(caps.Capabilities, capRendezvous)
+	}
+
+	return caps
+}
+
+// peerCapabilities retrieves the capabilities of a peer (which has none if it doesn't advertise a protocol version)
+func (s *Server) peerCapabilities(m RoomMember) apiResCapabilities {
+	if m.Version == 0 {
+		return apiResCapabilities{}
+	}
+	if caps, ok := s.peerCaps.get(m.UUID, m.Version); ok {
+		return caps
+	}
+
+	var caps apiResCapabilities
+	if err := JSONReq(s.client, http.MethodGet, peerURL(m.UUID, "/capabilities"), nil, &caps); err != nil {
+		log.WithField("id", m.UUID).WithError(err).Debug("Failed to retrieve peer capabilities")
+		return apiResCapabilities{Version: negotiateVersion(m.Version)}
+	}
+	// the advertised version is the one used to decide when to refresh the cache
+	caps.Version = m.Version
+
+	s.peerCaps.set(m.UUID, caps)
+	return caps
+}
+
+// apiCapabilities describes the protocol version and optional features supported by this server
+func (s *Server) apiCapabilities(w http.ResponseWriter, r *http.Request) {
+	JSONResponse(w, s.capabilities(), http.StatusOK)
+}
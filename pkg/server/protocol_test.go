@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	for _, c := range []struct {
+		advertised, version int
+		path                string
+	}{
+		{-1, 0, "/rooms/test/message"},
+		{0, 0, "/rooms/test/message"},
+		{protocolVersion, protocolVersion, "/v1/rooms/test/message"},
+		{protocolVersion + 1, protocolVersion, "/v1/rooms/test/message"},
+	} {
+		v := negotiateVersion(c.advertised)
+		if v != c.version {
+			t.Errorf("advertised version %v: expected to use version %v, got %v", c.advertised, c.version, v)
+		}
+		if p := versionedPath(v, "/rooms/test/message"); p != c.path {
+			t.Errorf("version %v: expected path %v, got %v", v, c.path, p)
+		}
+	}
+}
+
+func TestCapabilityBody(t *testing.T) {
+	b := capabilityBody{capHistory, "body"}
+	if _, ok := b.forPeer(apiResCapabilities{}); ok {
+		t.Error("expected body not to be sent to a peer without the capability")
+	}
+	if body, ok := b.forPeer(apiResCapabilities{Capabilities: []string{capHistory}}); !ok || body != "body" {
+		t.Errorf("expected body to be sent to a peer with the capability, got %v", body)
+	}
+}
+
+func TestPeerCapabilities(t *testing.T) {
+	registry := NewMemoryRegistry()
+	a := newTestServer(t, registry)
+	b := newTestServer(t, registry)
+	trust(t, a, b)
+	uiRequest(t, b, http.MethodPost, "/api/rooms/test", "")
+	eventually(t, "member to be discovered", func() bool {
+		return inRoom(a, "test", b)
+	})
+
+	m, _ := a.discovery.Lookup(b.id)
+	if m.Version != protocolVersion {
+		t.Fatalf("expected member to advertise version %v, got %v", protocolVersion, m.Version)
+	}
+	caps := a.peerCapabilities(m)
+	if caps.Version != protocolVersion || !caps.has(capRelay) || caps.has(capRendezvous) {
+		t.Errorf("unexpected peer capabilities %+v", caps)
+	}
+	if cached, ok := a.peerCaps.get(b.id, protocolVersion); !ok || !cached.has(capRelay) {
+		t.Error("expected peer capabilities to be cached")
+	}
+
+	m.Version = 0
+	if caps := a.peerCapabilities(m); caps.Version != 0 || len(caps.Capabilities) != 0 {
+		t.Errorf("expected unversioned peer to have no capabilities, got %+v", caps)
+	}
+}
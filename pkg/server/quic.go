@@ -0,0 +1,455 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/quic-go/quic-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// quicALPN is the application protocol negotiated on QUIC connections between peers
+const quicALPN = "cryptochat"
+
+// quicDialTimeout is how long to wait for a QUIC connection to a peer to be established
+const quicDialTimeout = 10 * time.Second
+
+// quicIdleTimeout is how long a QUIC connection can go without hearing from the peer before it is closed
+const quicIdleTimeout = 30 * time.Second
+
+// quicKeepAlive is how often an idle QUIC connection is checked for liveness
+const quicKeepAlive = 10 * time.Second
+
+// quicRequestTimeout is how long to wait for the response to a request made over QUIC
+const quicRequestTimeout = 30 * time.Second
+
+// quicRetryDelay is how long to wait before trying to connect to a peer over QUIC again after failing to
+const quicRetryDelay = time.Minute
+
+// errQUICUnverified means a peer tried to connect over QUIC before being verified
+var errQUICUnverified = errors.New("peer must be verified before connecting over QUIC")
+
+// errQUICUnavailable means a request couldn't be made over QUIC (and should be made over TCP instead)
+var errQUICUnavailable = errors.New("QUIC unavailable")
+
+// lossyPacketConn drops a proportion of the packets sent over a connection, to simulate a lossy link
+type lossyPacketConn struct {
+	net.PacketConn
+	loss float64
+}
+
+func (c lossyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if rand.Float64() < c.loss {
+		return len(b), nil
+	}
+
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// verifyQUICPeer checks a peer's certificate with verifyPeer, but rejects peers which haven't been verified yet rather
+// than waiting (the handshake would time out), so that verification happens over TCP
+func (s *Server) verifyQUICPeer(certs [][]byte, chains [][]*x509.Certificate) error {
+	if len(certs) == 0 {
+		return errors.New("no certificate presented")
+	}
+	if u, err := s.userForCert(certs[0]); err != nil || !u.Verified {
+		return errQUICUnverified
+	}
+
+	return s.verifyPeer(certs, chains)
+}
+
+// quicStreamConn adapts a QUIC stream to a net.Conn, so that an HTTP request can be carried over it
+type quicStreamConn struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+func (c quicStreamConn) Close() error {
+	c.CancelRead(0)
+	// closes the write direction only
+	return c.Stream.Close()
+}
+
+func (c quicStreamConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c quicStreamConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// quicListener hands the streams opened by peers to the HTTP server
+type quicListener struct {
+	addr    net.Addr
+	streams chan net.Conn
+
+	closeOnce sync.Once
+	quit      chan struct{}
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.streams:
+		return c, nil
+	case <-l.quit:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *quicListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.quit)
+	})
+	return nil
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return l.addr
+}
+
+// quicTransport carries the peer API over QUIC. A single connection is shared by both peers, each HTTP request being
+// made on its own stream.
+type quicTransport struct {
+	s    *Server
+	loss float64
+
+	transport *quic.Transport
+	accepter  *quic.Listener
+	listener  *quicListener
+	server    http.Server
+	client    *http.Client
+	tlsConfig *tls.Config
+
+	lock  sync.Mutex
+	conns map[uuid.UUID]quic.Connection
+	// dialing has a channel for each peer a connection is being made to, which is closed once the attempt finishes
+	dialing map[uuid.UUID]chan struct{}
+	failed  map[uuid.UUID]time.Time
+}
+
+// newQUICTransport creates a QUIC transport, dropping a proportion `loss` of packets (for testing)
+func newQUICTransport(s *Server, loss float64) *quicTransport {
+	t := &quicTransport{
+		s:    s,
+		loss: loss,
+
+		server: http.Server{
+			BaseContext: s.api.BaseContext,
+			ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+				return context.WithValue(ctx, keyConnState, c.(quicStreamConn).conn.ConnectionState().TLS)
+			},
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				state := r.Context().Value(keyConnState).(tls.ConnectionState)
+				r.TLS = &state
+
+				s.api.Handler.ServeHTTP(w, r)
+			}),
+		},
+		tlsConfig: &tls.Config{
+			Certificates: s.api.TLSConfig.Certificates,
+			NextProtos:   []string{quicALPN},
+
+			InsecureSkipVerify:    true,
+			VerifyPeerCertificate: s.verifyQUICPeer,
+		},
+
+		conns:   make(map[uuid.UUID]quic.Connection),
+		dialing: make(map[uuid.UUID]chan struct{}),
+		failed:  make(map[uuid.UUID]time.Time),
+	}
+	t.client = &http.Client{
+		Transport: &http.Transport{
+			DialTLSContext:  t.dialStream,
+			IdleConnTimeout: quicIdleTimeout,
+		},
+		Timeout: quicRequestTimeout,
+	}
+
+	return t
+}
+
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: quicDialTimeout,
+		MaxIdleTimeout:       quicIdleTimeout,
+		KeepAlivePeriod:      quicKeepAlive,
+	}
+}
+
+// listen starts accepting QUIC connections on UDP port `port` of `host` (or any free port if it is in use)
+func (t *quicTransport) listen(host string, port int) error {
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		log.WithField("port", port).WithError(err).Debug("Failed to listen for QUIC on API port, using any free port")
+		if pc, err = net.ListenPacket("udp", net.JoinHostPort(host, "0")); err != nil {
+			return fmt.Errorf("failed to start API UDP listener: %w", err)
+		}
+	}
+	if t.loss > 0 {
+		pc = lossyPacketConn{pc, t.loss}
+	}
+
+	serverTLS := &tls.Config{
+		Certificates: t.s.api.TLSConfig.Certificates,
+		NextProtos:   []string{quicALPN},
+
+		ClientAuth:            tls.RequestClientCert,
+		VerifyPeerCertificate: t.s.verifyQUICPeer,
+	}
+	t.transport = &quic.Transport{Conn: pc}
+	if t.accepter, err = t.transport.Listen(serverTLS, quicConfig()); err != nil {
+		pc.Close()
+		return fmt.Errorf("failed to start QUIC listener: %w", err)
+	}
+
+	t.listener = &quicListener{
+		addr:    pc.LocalAddr(),
+		streams: make(chan net.Conn),
+		quit:    make(chan struct{}),
+	}
+	return nil
+}
+
+// port retrieves the UDP port QUIC connections are accepted on
+func (t *quicTransport) port() int {
+	return t.transport.Conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// serve accepts QUIC connections and serves requests made over them until close is called
+func (t *quicTransport) serve() error {
+	go func() {
+		for {
+			conn, err := t.accepter.Accept(context.Background())
+			if err != nil {
+				return
+			}
+
+			t.add(conn)
+		}
+	}()
+
+	return t.server.Serve(t.listener)
+}
+
+// add starts accepting the streams opened over a connection, and making requests over it (unless there is already a
+// connection to the same peer)
+func (t *quicTransport) add(conn quic.Connection) {
+	state := conn.ConnectionState().TLS
+	if len(state.PeerCertificates) == 0 {
+		conn.CloseWithError(0, "no client certificate")
+		return
+	}
+	id, err := uuid.Parse(state.PeerCertificates[0].Subject.CommonName)
+	if err != nil {
+		conn.CloseWithError(0, "invalid client certificate")
+		return
+	}
+
+	t.lock.Lock()
+	// when both ends connect at the same time, each continues to make requests over its own connection
+	if _, ok := t.conns[id]; !ok {
+		t.conns[id] = conn
+		delete(t.failed, id)
+	}
+	t.lock.Unlock()
+
+	go func() {
+		for {
+			stream, err := conn.AcceptStream(context.Background())
+			if err != nil {
+				break
+			}
+
+			select {
+			case t.listener.streams <- quicStreamConn{stream, conn}:
+			case <-t.listener.quit:
+				stream.CancelRead(0)
+				stream.CancelWrite(0)
+			}
+		}
+
+		t.lock.Lock()
+		if t.conns[id] == conn {
+			delete(t.conns, id)
+		}
+		t.lock.Unlock()
+		log.WithField("id", id).Debug("QUIC connection closed")
+	}()
+}
+
+// get retrieves the connection to a peer, making one if necessary
+func (t *quicTransport) get(id uuid.UUID) (quic.Connection, error) {
+	if u, err := t.s.getUser(id.String()); err != nil || !u.Verified {
+		// the peer would reject the connection, verification has to happen over TCP first
+		return nil, errQUICUnavailable
+	}
+
+	for {
+		t.lock.Lock()
+		if conn, ok := t.conns[id]; ok {
+			t.lock.Unlock()
+			return conn, nil
+		}
+		if f, ok := t.failed[id]; ok && time.Since(f) < quicRetryDelay {
+			t.lock.Unlock()
+			return nil, errQUICUnavailable
+		}
+		if ch, ok := t.dialing[id]; ok {
+			t.lock.Unlock()
+			<-ch
+			continue
+		}
+
+		ch := make(chan struct{})
+		t.dialing[id] = ch
+		t.lock.Unlock()
+
+		err := t.dial(id)
+
+		t.lock.Lock()
+		delete(t.dialing, id)
+		if err != nil {
+			t.failed[id] = time.Now()
+		}
+		t.lock.Unlock()
+		close(ch)
+
+		if err != nil {
+			log.WithField("id", id).WithError(err).Debug("Failed to connect to peer over QUIC")
+			return nil, errQUICUnavailable
+		}
+	}
+}
+
+// dial connects to a peer, trying each of its addresses at once and keeping the first connection made
+func (t *quicTransport) dial(id uuid.UUID) error {
+	m, ok := t.s.discovery.Lookup(id)
+	if !ok {
+		return fmt.Errorf("peer %v not found", id)
+	}
+	if m.QUICPort == 0 {
+		return errors.New("peer does not accept QUIC connections")
+	}
+
+	addrs := peerAddrs(m.Addrs, m.Zone, m.QUICPort)
+	if len(addrs) == 0 {
+		return fmt.Errorf("no addresses known for peer %v", id)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), quicDialTimeout)
+	defer cancel()
+
+	type result struct {
+		conn quic.Connection
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	for _, addr := range addrs {
+		go func(addr string) {
+			udpAddr, err := net.ResolveUDPAddr("udp", addr)
+			if err != nil {
+				results <- result{nil, err}
+				return
+			}
+
+			conn, err := t.transport.Dial(ctx, udpAddr, t.tlsConfig, quicConfig())
+			results <- result{conn, err}
+		}(addr)
+	}
+
+	var conn quic.Connection
+	var err error
+	for range addrs {
+		r := <-results
+		switch {
+		case r.err != nil:
+			err = r.err
+		case conn != nil:
+			r.conn.CloseWithError(0, "")
+		default:
+			conn = r.conn
+			cancel()
+		}
+	}
+	if conn == nil {
+		return err
+	}
+
+	if cn := conn.ConnectionState().TLS.PeerCertificates[0].Subject.CommonName; cn != id.String() {
+		conn.CloseWithError(0, "unexpected peer")
+		return fmt.Errorf("peer presented certificate for %v", cn)
+	}
+
+	t.add(conn)
+	return nil
+}
+
+// dialStream opens a new stream to the peer whose UUID is the host part of `addr`, returning an error wrapping
+// errQUICUnavailable if it can't (in which case nothing has been sent)
+func (t *quicTransport) dialStream(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errQUICUnavailable, err)
+	}
+	id, err := uuid.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errQUICUnavailable, err)
+	}
+
+	conn, err := t.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to open stream: %v", errQUICUnavailable, err)
+	}
+	return quicStreamConn{stream, conn}, nil
+}
+
+// request makes a request to a member's peer API over QUIC, returning errQUICUnavailable if the request couldn't be
+// sent. Once it has been sent, any error is returned as is, since making the request again over TCP might repeat it.
+func (t *quicTransport) request(m RoomMember, method, path string, body, res interface{}) error {
+	err := JSONReq(t.client, method, peerURL(m.UUID, path), body, res)
+	if errors.Is(err, errQUICUnavailable) {
+		log.WithField("id", m.UUID).WithError(err).Debug("Failed to make request over QUIC")
+		return errQUICUnavailable
+	}
+	return err
+}
+
+// quicPort retrieves the UDP port QUIC connections are accepted on (0 if QUIC isn't enabled)
+func (s *Server) quicPort() int {
+	if s.quic == nil || s.quic.transport == nil {
+		return 0
+	}
+
+	return s.quic.port()
+}
+
+// close closes all QUIC connections and stops accepting new ones
+func (t *quicTransport) close() {
+	if t.listener == nil {
+		return
+	}
+
+	// closes the listener too
+	t.server.Close()
+
+	t.accepter.Close()
+	// closes all connections, but not the UDP socket
+	t.transport.Close()
+	t.transport.Conn.Close()
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestQUICLossyLoopback(t *testing.T) {
+	registry := NewMemoryRegistry()
+	config := Config{
+		Discovery: registry.NewDiscovery,
+		QUIC:      true,
+		QUICLoss:  0.2,
+	}
+	a := newTestServerConfig(t, config)
+	b := newTestServerConfig(t, config)
+	trust(t, a, b)
+
+	uiRequest(t, a, http.MethodPost, "/api/rooms/test", "")
+	uiRequest(t, b, http.MethodPost, "/api/rooms/test", "")
+	eventually(t, "members to see each other join", func() bool {
+		return inRoom(a, "test", b) && inRoom(b, "test", a)
+	})
+	member, ok := a.discovery.Lookup(b.id)
+	if !ok {
+		t.Fatal("peer not found")
+	}
+
+	// the messages are sent over QUIC directly, so that nothing can fall back to TCP
+	const count = 10
+	path := versionedPath(negotiateVersion(member.Version), "/rooms/test/message")
+	for i := 0; i < count; i++ {
+		m := Message{
+			ID:       uuid.New(),
+			Room:     "test",
+			Sender:   a.id,
+			Username: "a",
+			Content:  fmt.Sprintf("message %v", i),
+			Sent:     time.Now(),
+			Clock:    int64(i + 1),
+		}
+		sig, err := a.sign(m.signingData())
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Signature = sig
+
+		if err := a.quic.request(member, http.MethodPost, path, newAPIReqSendMessage(m), nil); err != nil {
+			t.Fatalf("failed to send message %v over QUIC: %v", i, err)
+		}
+	}
+
+	history, err := b.getRoomHistory("test")
+	if err != nil {
+		t.Fatalf("failed to retrieve history: %v", err)
+	}
+	if len(history) != count {
+		t.Errorf("expected %v messages to be delivered, got %v", count, len(history))
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// UnreadInfo describes the unread messages in a room
+type UnreadInfo struct {
+	Count       int
+	FirstUnread uuid.UUID
+}
+
+// setReadMarker marks all messages in a room up to and including `m` as read
+func (s *Server) setReadMarker(m Message) error {
+	if _, err := s.stmts.setReadMarker.Exec(m.Room, m.ID[:], m.Clock, m.Sender[:]); err != nil {
+		return fmt.Errorf("failed to update read marker: %w", err)
+	}
+
+	return nil
+}
+
+// getUnread retrieves unread message information for each room with unread messages
+func (s *Server) getUnread() (map[string]UnreadInfo, error) {
+	rows, err := s.stmts.unreadCounts.Query(s.id[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database for unread messages: %w", err)
+	}
+	defer rows.Close()
+
+	unread := make(map[string]UnreadInfo)
+	for rows.Next() {
+		var (
+			room string
+			info UnreadInfo
+		)
+		if err := rows.Scan(&room, &info.FirstUnread, &info.Count); err != nil {
+			return nil, fmt.Errorf("failed to read unread count from query result: %w", err)
+		}
+
+		unread[room] = info
+	}
+
+	return unread, rows.Err()
+}
+
+// setReadReceipt records that `user` has read all messages in a room up to and including `m`
+func (s *Server) setReadReceipt(m Message, user uuid.UUID) error {
+	if _, err := s.stmts.setReadReceipt.Exec(m.Room, user[:], m.ID[:], m.Clock, m.Sender[:]); err != nil {
+		return fmt.Errorf("failed to update read receipt: %w", err)
+	}
+
+	return nil
+}
+
+// getReadReceipts retrieves the users who have read a message
+func (s *Server) getReadReceipts(id uuid.UUID) ([]uuid.UUID, error) {
+	rows, err := s.stmts.messageReadReceipts.Query(id[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database for read receipts: %w", err)
+	}
+	defer rows.Close()
+
+	users := []uuid.UUID{}
+	for rows.Next() {
+		var user uuid.UUID
+		if err := rows.Scan(&user); err != nil {
+			return nil, fmt.Errorf("failed to read receipt from query result: %w", err)
+		}
+
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestReadMarkers(t *testing.T) {
+	s := newTestServer(t, NewMemoryRegistry())
+	sender, reader := uuid.New(), uuid.New()
+
+	sent := time.Now().UTC()
+	messages := make([]Message, 4)
+	for i := range messages {
+		messages[i] = Message{
+			ID:       uuid.New(),
+			Room:     "test",
+			Sender:   sender,
+			Username: "sender",
+			Content:  "hello",
+			Sent:     sent.Add(time.Duration(i) * time.Second),
+			Clock:    int64(i + 1),
+		}
+		if err := s.addMessage(messages[i]); err != nil {
+			t.Fatalf("failed to add message: %v", err)
+		}
+	}
+
+	unread, err := s.getUnread()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := unread["test"]; info.Count != 4 || info.FirstUnread != messages[0].ID {
+		t.Errorf("expected 4 unread messages starting at %v, got %+v", messages[0].ID, info)
+	}
+
+	if err := s.setReadMarker(messages[1]); err != nil {
+		t.Fatal(err)
+	}
+	if unread, err = s.getUnread(); err != nil {
+		t.Fatal(err)
+	}
+	if info := unread["test"]; info.Count != 2 || info.FirstUnread != messages[2].ID {
+		t.Errorf("expected 2 unread messages starting at %v, got %+v", messages[2].ID, info)
+	}
+
+	if err := s.setReadReceipt(messages[2], reader); err != nil {
+		t.Fatal(err)
+	}
+	for i, read := range []bool{true, true, true, false} {
+		users, err := s.getReadReceipts(messages[i].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (len(users) == 1 && users[0] == reader) != read {
+			t.Errorf("message %v: expected read to be %v, got receipts %v", i, read, users)
+		}
+	}
+}
+
+func TestReceiptOrder(t *testing.T) {
+	s := newTestServer(t, NewMemoryRegistry())
+	sender, reader := uuid.New(), uuid.New()
+
+	// every message is sent at the same time, so that only their clocks order them
+	sent := time.Now().UTC()
+	messages := make([]Message, 4)
+	for i := range messages {
+		messages[i] = Message{
+			ID:       uuid.New(),
+			Room:     "test",
+			Sender:   sender,
+			Username: "sender",
+			Content:  "hello",
+			Sent:     sent,
+			Clock:    int64(len(messages) - i),
+		}
+		if err := s.addMessage(messages[i]); err != nil {
+			t.Fatalf("failed to add message: %v", err)
+		}
+	}
+
+	// messages[1] has clock 3, so only messages[3] (clock 1) and messages[2] (clock 2) come before it
+	if err := s.setReadReceipt(messages[1], reader); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.setReadReceipt(messages[2], reader); err != nil {
+		t.Fatal(err)
+	}
+	for i, read := range []bool{false, true, true, true} {
+		users, err := s.getReadReceipts(messages[i].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (len(users) == 1 && users[0] == reader) != read {
+			t.Errorf("message with clock %v: expected read to be %v, got receipts %v", messages[i].Clock, read, users)
+		}
+	}
+
+	if err := s.setReadMarker(messages[2]); err != nil {
+		t.Fatal(err)
+	}
+	unread, err := s.getUnread()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := unread["test"]; info.Count != 2 || info.FirstUnread != messages[1].ID {
+		t.Errorf("expected 2 unread messages starting at %v, got %+v", messages[1].ID, info)
+	}
+}
+
+func TestMessageClockBound(t *testing.T) {
+	s := newTestServer(t, NewMemoryRegistry())
+
+	for _, c := range []struct {
+		clock int64
+		valid bool
+	}{
+		{-1, false},
+		{0, true},
+		{maxClockSkew, true},
+		{maxClockSkew + 1, false},
+	} {
+		_, err := s.messageFromRequest("test", uuid.New(), apiReqSendMessage{
+			ID:    uuid.New().String(),
+			Clock: c.clock,
+		})
+		if (err == nil) != c.valid {
+			t.Errorf("clock %v: expected valid to be %v, got error %v", c.clock, c.valid, err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxRelayHops is the most times a message can be forwarded between relays before reaching its target
+const maxRelayHops = 3
+
+// relayFanout is how many members a message is passed to when it needs relaying
+const relayFanout = 3
+
+// relaySeenExpiry is how long relayed message IDs are remembered for (to avoid forwarding a message more than once)
+const relaySeenExpiry = 10 * time.Minute
+
+// apiSignedMessage is a message signed by its sender, allowing other members to pass it on
+type apiSignedMessage struct {
+	apiReqSendMessage
+	Room   string    `json:"room"`
+	Sender uuid.UUID `json:"sender"`
+}
+
+type apiReqRelay struct {
+	// Message is a signed apiSignedMessage
+	Message signedPayload `json:"message"`
+	// Targets are the members the message should be delivered to
+	Targets []uuid.UUID `json:"targets"`
+	// Hops is the number of times the message may still be forwarded
+	Hops int `json:"hops"`
+	// Path lists the members the message has already passed through
+	Path []uuid.UUID `json:"path"`
+}
+
+// relayCandidates picks verified members of a room to relay a message through
+func (s *Server) relayCandidates(room string, exclude []uuid.UUID) []RoomMember {
+	var candidates []RoomMember
+	for _, m := range s.discovery.GetRooms()[room] {
+		if containsUUID(exclude, m.UUID) {
+			continue
+		}
+		if u, err := s.getUser(m.UUID.String()); err != nil || !u.Verified {
+			continue
+		}
+		if !s.peerCapabilities(m).has(capRelay) {
+			continue
+		}
+
+		candidates = append(candidates, m)
+		if len(candidates) == relayFanout {
+			break
+		}
+	}
+
+	return candidates
+}
+
+// forwardRelay asks other members of a room to deliver a message to the request's targets
+func (s *Server) forwardRelay(room string, req apiReqRelay) {
+	l := log.WithFields(log.Fields{
+		"room":    room,
+		"targets": req.Targets,
+	})
+
+	candidates := s.relayCandidates(room, append(append([]uuid.UUID{}, req.Path...), req.Targets...))
+	if len(candidates) == 0 {
+		l.Warn("No members available to relay message")
+		return
+	}
+
+	path := fmt.Sprintf("/rooms/%v/relay", url.PathEscape(room))
+	for _, c := range candidates {
+		if err := s.sendToMember(room, c, http.MethodPost, path, req); err != nil {
+			l.WithField("relay", c.UUID).WithError(err).Debug("Failed to send message to relay")
+		}
+	}
+}
+
+// relayMessage signs a message sent by this user and asks other members to deliver it to those who couldn't be
+// reached directly
+func (s *Server) relayMessage(room string, b apiReqSendMessage, unreachable []RoomMember) {
+	p, err := s.signPayload(apiSignedMessage{
+		apiReqSendMessage: b,
+		Room:              room,
+		Sender:            s.id,
+	})
+	if err != nil {
+		log.WithError(err).Error("Failed to sign message for relaying")
+		return
+	}
+
+	targets := make([]uuid.UUID, len(unreachable))
+	for i, m := range unreachable {
+		targets[i] = m.UUID
+	}
+
+	if id, err := uuid.Parse(b.ID); err == nil {
+		s.relays.markSeen(id)
+	}
+	s.forwardRelay(room, apiReqRelay{
+		Message: p,
+		Targets: targets,
+		Hops:    maxRelayHops,
+		Path:    []uuid.UUID{s.id},
+	})
+}
+
+// relayOnward delivers a relayed message to its remaining targets, passing it on to other relays for those which
+// can't be reached directly
+func (s *Server) relayOnward(room string, req apiReqRelay) {
+	next := apiReqRelay{
+		Message: req.Message,
+		Hops:    req.Hops - 1,
+		Path:    append(append([]uuid.UUID{}, req.Path...), s.id),
+	}
+
+	members := s.discovery.GetRooms()[room]
+	path := fmt.Sprintf("/rooms/%v/relay", url.PathEscape(room))
+
+	var unreachable []uuid.UUID
+	for _, t := range req.Targets {
+		if t == s.id || containsUUID(req.Path, t) {
+			continue
+		}
+
+		delivered := false
+		for _, m := range members {
+			if m.UUID != t {
+				continue
+			}
+			if !s.peerCapabilities(m).has(capRelay) {
+				// older members can only receive messages directly from their sender
+				break
+			}
+
+			direct := next
+			direct.Targets = []uuid.UUID{t}
+			if err := s.sendToMember(room, m, http.MethodPost, path, direct); err != nil {
+				log.WithFields(log.Fields{
+					"room": room,
+					"id":   t,
+				}).WithError(err).Debug("Failed to deliver relayed message")
+			} else {
+				delivered = true
+			}
+			break
+		}
+
+		if !delivered {
+			unreachable = append(unreachable, t)
+		}
+	}
+
+	if len(unreachable) != 0 && next.Hops > 0 {
+		next.Targets = unreachable
+		s.forwardRelay(room, next)
+	}
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestRelay(t *testing.T) {
+	registry := NewMemoryRegistry()
+	a := newTestServer(t, registry)
+	b := newTestServer(t, registry)
+	c := newTestServer(t, registry)
+	for _, p := range [][2]*Server{{a, b}, {a, c}, {b, c}} {
+		trust(t, p[0], p[1])
+	}
+	for _, s := range []*Server{a, b, c} {
+		uiRequest(t, s, http.MethodPost, "/api/rooms/test", "")
+	}
+	uiRequest(t, b, http.MethodPut, "/api/settings", `{"relay":true}`)
+	eventually(t, "members to be discovered", func() bool {
+		return inRoom(a, "test", b) && inRoom(a, "test", c) && inRoom(b, "test", c)
+	})
+
+	var target RoomMember
+	for _, m := range a.discovery.GetRooms()["test"] {
+		if m.UUID == c.id {
+			target = m
+		}
+	}
+
+	// pretend that a couldn't reach c, so that the message goes through b
+	id := uuid.New()
+	a.relayMessage("test", apiReqSendMessage{
+		ID:       id.String(),
+		Time:     time.Now(),
+		Username: "a",
+		Content:  "hello",
+	}, []RoomMember{target})
+
+	eventually(t, "relayed message to be delivered", func() bool {
+		m, err := c.getMessage(id)
+		return err == nil && m.Sender == a.id && m.Content == "hello"
+	})
+	if _, err := b.getMessage(id); !errors.Is(err, errMessageNotFound) {
+		t.Errorf("expected relay not to store message it wasn't a target of, got %v", err)
+	}
+
+	// the same message arriving again (e.g. directly) is ignored
+	m, _ := c.getMessage(id)
+	if err := c.addMessage(m); !errors.Is(err, errDuplicateMessage) {
+		t.Errorf("expected duplicate message error, got %v", err)
+	}
+	if err := c.receiveMessage(m); err != nil {
+		t.Errorf("expected duplicate message to be ignored, got %v", err)
+	}
+}
@@ -0,0 +1,341 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// rendezvousInterval is how often nodes re-register with (and query) rendezvous nodes
+const rendezvousInterval = 20 * time.Second
+const rendezvousTimeout = 10 * time.Second
+
+// rendezvousTTL is how long a registration lasts without being renewed
+const rendezvousTTL = 3 * rendezvousInterval
+
+// apiRendezvousPeer is a node's registration with a rendezvous node
+type apiRendezvousPeer struct {
+	apiPeerInfo
+	Addrs []net.IP `json:"addrs"`
+	Port  int      `json:"port"`
+}
+
+// member converts a registration into a room member
+func (p apiRendezvousPeer) member(id uuid.UUID) RoomMember {
+	member := RoomMember{
+		UUID:     id,
+		Addrs:    p.Addrs,
+		Port:     p.Port,
+		Version:  p.Version,
+		QUICPort: p.QUICPort,
+		Presence: p.Presence,
+		LastSeen: time.Now(),
+	}
+	if err := member.Presence.validate(); err != nil {
+		member.Presence = Presence{Status: StatusOnline}
+	}
+
+	return member
+}
+
+type rendezvousEntry struct {
+	peer    apiRendezvousPeer
+	expires time.Time
+}
+
+// rendezvousRegistry keeps track of the nodes registered with this one (when acting as a rendezvous node), also
+// acting as a discovery backend so that this node can see them
+type rendezvousRegistry struct {
+	peerTable
+
+	lock    sync.Mutex
+	entries map[uuid.UUID]rendezvousEntry
+
+	quit chan struct{}
+}
+
+func newRendezvousRegistry() *rendezvousRegistry {
+	return &rendezvousRegistry{
+		peerTable: newPeerTable(),
+
+		entries: make(map[uuid.UUID]rendezvousEntry),
+
+		quit: make(chan struct{}),
+	}
+}
+
+// register adds or renews a node's registration
+func (r *rendezvousRegistry) register(id uuid.UUID, p apiRendezvousPeer) {
+	r.lock.Lock()
+	r.entries[id] = rendezvousEntry{p, time.Now().Add(rendezvousTTL)}
+	r.lock.Unlock()
+
+	r.updateMember(p.member(id), roomAdvert{
+		Rooms:   p.Rooms,
+		Private: p.PrivateRooms,
+	})
+}
+
+func (r *rendezvousRegistry) unregister(id uuid.UUID) {
+	r.lock.Lock()
+	delete(r.entries, id)
+	r.lock.Unlock()
+
+	r.removeMember(id)
+}
+
+// peers retrieves all current registrations except the one for `exclude`
+func (r *rendezvousRegistry) peers(exclude uuid.UUID) []apiRendezvousPeer {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	peers := []apiRendezvousPeer{}
+	for id, e := range r.entries {
+		if id != exclude && now.Before(e.expires) {
+			peers = append(peers, e.peer)
+		}
+	}
+
+	return peers
+}
+
+// Start expires registrations which have not been renewed until Close is called
+func (r *rendezvousRegistry) Start(apiPort, quicPort int) error {
+	t := time.NewTicker(rendezvousInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			now := time.Now()
+			r.lock.Lock()
+			for id, e := range r.entries {
+				if now.After(e.expires) {
+					delete(r.entries, id)
+				}
+			}
+			r.lock.Unlock()
+
+			r.expireMembers(now.Add(-rendezvousTTL))
+		case <-r.quit:
+			return nil
+		}
+	}
+}
+
+// Close stops expiring registrations
+func (r *rendezvousRegistry) Close() error {
+	close(r.quit)
+	r.events.close()
+
+	return nil
+}
+
+// SetPresence updates the presence of this user (registered nodes find it by probing this node as a static peer)
+func (r *rendezvousRegistry) SetPresence(p Presence) {
+	r.setPresence(p)
+}
+
+// SetRoomSecret makes a room private, advertising it by a tag derived from `secret` (or public if nil)
+func (r *rendezvousRegistry) SetRoomSecret(room string, secret []byte) {
+	r.setRoomSecret(room, secret)
+}
+
+// AddRoom adds a room to the list of rooms this user is in
+func (r *rendezvousRegistry) AddRoom(room string) bool {
+	return r.addRoom(room)
+}
+
+// RemoveRoom removes a room from the list of rooms this user is in
+func (r *rendezvousRegistry) RemoveRoom(room string) bool {
+	return r.removeRoom(room)
+}
+
+// localAddrs lists the non-loopback addresses of this machine
+func localAddrs() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.WithError(err).Warn("Failed to list local addresses")
+		return nil
+	}
+
+	ips := []net.IP{}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() && !n.IP.IsLinkLocalUnicast() {
+			ips = append(ips, n.IP)
+		}
+	}
+	return ips
+}
+
+// rendezvousDiscovery finds peers by registering with and querying rendezvous nodes, allowing peers on other subnets
+// to be reached (messages are still sent directly between peers)
+type rendezvousDiscovery struct {
+	peerTable
+
+	id       uuid.UUID
+	client   *http.Client
+	servers  []string
+	port     int
+	quicPort int
+
+	// changed triggers an early registration when the rooms or presence of this user change
+	changed chan struct{}
+	quit    chan struct{}
+}
+
+func newRendezvousDiscovery(id uuid.UUID, servers []string) *rendezvousDiscovery {
+	return &rendezvousDiscovery{
+		peerTable: newPeerTable(),
+
+		id:      id,
+		servers: servers,
+
+		changed: make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+	}
+}
+
+// registration builds the advertisement sent to rendezvous nodes
+func (d *rendezvousDiscovery) registration() apiRendezvousPeer {
+	rooms, presence := d.advertisement()
+
+	return apiRendezvousPeer{
+		apiPeerInfo: apiPeerInfo{
+			UUID:         d.id.String(),
+			Version:      protocolVersion,
+			QUICPort:     d.quicPort,
+			Rooms:        rooms.Rooms,
+			PrivateRooms: rooms.Private,
+			Presence:     presence,
+		},
+		Addrs: localAddrs(),
+		Port:  d.port,
+	}
+}
+
+// sync registers with a rendezvous node and updates the peers registered with it
+func (d *rendezvousDiscovery) sync(server string) error {
+	if err := JSONReq(d.client, http.MethodPut, fmt.Sprintf("https://%v/rendezvous/registration", server),
+		d.registration(), nil); err != nil {
+		return fmt.Errorf("failed to register: %w", err)
+	}
+
+	var peers []apiRendezvousPeer
+	if err := JSONReq(d.client, http.MethodGet, fmt.Sprintf("https://%v/rendezvous/peers", server), nil,
+		&peers); err != nil {
+		return fmt.Errorf("failed to retrieve peers: %w", err)
+	}
+
+	for _, p := range peers {
+		id, err := uuid.Parse(p.UUID)
+		if err != nil || id == d.id {
+			continue
+		}
+
+		d.updateMember(p.member(id), roomAdvert{
+			Rooms:   p.Rooms,
+			Private: p.PrivateRooms,
+		})
+	}
+
+	return nil
+}
+
+func (d *rendezvousDiscovery) syncAll() {
+	for _, server := range d.servers {
+		go func(server string) {
+			if err := d.sync(server); err != nil {
+				log.WithField("server", server).WithError(err).Warn("Failed to sync with rendezvous node")
+			}
+		}(server)
+	}
+}
+
+// Start registers with the rendezvous nodes periodically until Close is called
+func (d *rendezvousDiscovery) Start(apiPort, quicPort int) error {
+	d.port = apiPort
+	d.quicPort = quicPort
+	d.syncAll()
+
+	t := time.NewTicker(rendezvousInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			d.expireMembers(time.Now().Add(-rendezvousTTL))
+			d.syncAll()
+		case <-d.changed:
+			d.syncAll()
+		case <-d.quit:
+			return nil
+		}
+	}
+}
+
+// Close unregisters from the rendezvous nodes
+func (d *rendezvousDiscovery) Close() error {
+	close(d.quit)
+
+	var wg sync.WaitGroup
+	for _, server := range d.servers {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+
+			if err := JSONReq(d.client, http.MethodDelete, fmt.Sprintf("https://%v/rendezvous/registration", server),
+				nil, nil); err != nil {
+				log.WithField("server", server).WithError(err).Debug("Failed to unregister from rendezvous node")
+			}
+		}(server)
+	}
+	wg.Wait()
+
+	d.events.close()
+	return nil
+}
+
+func (d *rendezvousDiscovery) notifyChanged() {
+	select {
+	case d.changed <- struct{}{}:
+	default:
+		// a registration is already pending
+	}
+}
+
+// SetPresence updates the presence advertised for this user
+func (d *rendezvousDiscovery) SetPresence(p Presence) {
+	d.setPresence(p)
+	d.notifyChanged()
+}
+
+// SetRoomSecret makes a room private, advertising it by a tag derived from `secret` (or public if nil)
+func (d *rendezvousDiscovery) SetRoomSecret(room string, secret []byte) {
+	d.setRoomSecret(room, secret)
+	d.notifyChanged()
+}
+
+// AddRoom adds a room to the list of rooms this user is in
+func (d *rendezvousDiscovery) AddRoom(room string) bool {
+	if !d.addRoom(room) {
+		return false
+	}
+
+	d.notifyChanged()
+	return true
+}
+
+// RemoveRoom removes a room from the list of rooms this user is in
+func (d *rendezvousDiscovery) RemoveRoom(room string) bool {
+	if !d.removeRoom(room) {
+		return false
+	}
+
+	d.notifyChanged()
+	return true
+}
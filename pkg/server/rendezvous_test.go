@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRendezvous(t *testing.T) {
+	node := newTestServerConfig(t, Config{
+		Discovery:        NewMemoryRegistry().NewDiscovery,
+		RendezvousServer: true,
+	})
+
+	api := httptest.NewUnstartedServer(node.api.Handler)
+	api.Config.BaseContext = node.api.BaseContext
+	api.TLS = node.api.TLSConfig
+	api.StartTLS()
+	defer api.Close()
+
+	// the servers can only find each other through the rendezvous node
+	config := Config{RendezvousNodes: []string{api.Listener.Addr().String()}}
+	config.Discovery = NewMemoryRegistry().NewDiscovery
+	a := newUnstartedTestServer(t, config)
+	config.Discovery = NewMemoryRegistry().NewDiscovery
+	b := newUnstartedTestServer(t, config)
+	// the servers register as soon as they start, which would otherwise wait for the node's user to verify them
+	trust(t, a, node)
+	trust(t, b, node)
+	trust(t, a, b)
+	startTestServer(t, a)
+	startTestServer(t, b)
+
+	uiRequest(t, b, http.MethodPost, "/api/rooms/test", "")
+	eventually(t, "registration with rendezvous node", func() bool {
+		return inRoom(node, "test", b)
+	})
+
+	uiRequest(t, a, http.MethodPost, "/api/rooms/test", "")
+	eventually(t, "peer to be found through rendezvous node", func() bool {
+		return inRoom(a, "test", b)
+	})
+
+	members := a.discovery.GetRooms()["test"]
+	for _, m := range members {
+		if m.UUID == b.id && (len(m.Addrs) == 0 || !m.Addrs[0].IsLoopback()) {
+			t.Errorf("expected address seen by rendezvous node to come first, got %v", m.Addrs)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"golang.org/x/text/unicode/norm"
+)
+
+// errRoomExists means a room cannot be created because someone else is already in it or created it
+var errRoomExists = errors.New("room already exists")
+
+// maxRoomNameLength is the longest (in bytes) a room name can be while still fitting in a single DNS TXT string
+// (which is at most 255 bytes) alongside the "room=" key
+const maxRoomNameLength = 255 - len("room=")
+
+// normalizeRoomName converts a room name into its canonical form (in Unicode normalization form C, with surrounding
+// whitespace removed and runs of whitespace collapsed into single spaces), returning an error if it cannot be used as a
+// room name
+func normalizeRoomName(name string) (string, error) {
+	if !utf8.ValidString(name) {
+		return "", errors.New("room name must be valid UTF-8")
+	}
+
+	// names which look the same should be the same room, however their characters were composed
+	name = norm.NFC.String(name)
+	name = strings.Join(strings.Fields(name), " ")
+	if name == "" {
+		return "", errors.New("room name cannot be empty")
+	}
+	if len(name) > maxRoomNameLength {
+		return "", fmt.Errorf("room name cannot be longer than %v bytes", maxRoomNameLength)
+	}
+
+	// these would be removed from API paths as dot segments
+	if name == "." || name == ".." {
+		return "", fmt.Errorf("room name cannot be %q", name)
+	}
+	for _, r := range name {
+		// slashes would be interpreted as separators in API paths
+		if r == '/' || !unicode.IsPrint(r) {
+			return "", fmt.Errorf("room name cannot contain %q", r)
+		}
+	}
+
+	return name, nil
+}
+
+// validRoomName checks if a room name is in canonical form
+func validRoomName(name string) bool {
+	n, err := normalizeRoomName(name)
+	return err == nil && n == name
+}
+
+// JoinedRoom is a room this user is in
+type JoinedRoom struct {
+	Room   string    `json:"room"`
+	Joined time.Time `json:"joined"`
+}
+
+// createRoom joins a new room with this user as its creator, returning false if they were already in it. It fails if a
+// peer is already in the room or it already has a different creator.
+func (s *Server) createRoom(room string) (bool, error) {
+	if len(s.discovery.GetRooms()[room]) != 0 {
+		return false, errRoomExists
+	}
+
+	creator, err := s.getRoomCreator(room)
+	if err != nil {
+		return false, err
+	}
+	if creator != uuid.Nil && creator != s.id {
+		return false, errRoomExists
+	}
+	if err := s.setRoomCreator(room, s.id); err != nil {
+		return false, err
+	}
+
+	return s.joinRoom(room)
+}
+
+// joinRoom adds this user to a room and remembers it across restarts, returning false if they were already in it
+func (s *Server) joinRoom(room string) (bool, error) {
+	if _, err := s.stmts.addJoinedRoom.Exec(room, time.Now().UTC()); err != nil {
+		return false, fmt.Errorf("failed to add joined room to database: %w", err)
+	}
+
+	return s.discovery.AddRoom(room), nil
+}
+
+// leaveRoom removes this user from a room, returning false if they were not in it
+func (s *Server) leaveRoom(room string) (bool, error) {
+	if _, err := s.stmts.removeJoinedRoom.Exec(room); err != nil {
+		return false, fmt.Errorf("failed to remove joined room from database: %w", err)
+	}
+
+	return s.discovery.RemoveRoom(room), nil
+}
+
+// getJoinedRooms retrieves the rooms this user is in, oldest first
+func (s *Server) getJoinedRooms() ([]JoinedRoom, error) {
+	rows, err := s.stmts.joinedRooms.Query()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database for joined rooms: %w", err)
+	}
+	defer rows.Close()
+
+	rooms := []JoinedRoom{}
+	for rows.Next() {
+		var r JoinedRoom
+		if err := rows.Scan(&r.Room, &r.Joined); err != nil {
+			return nil, fmt.Errorf("failed to read joined room from query result: %w", err)
+		}
+
+		rooms = append(rooms, r)
+	}
+
+	return rooms, rows.Err()
+}
+
+// restoreRooms rejoins the rooms this user was in before the server was last stopped
+func (s *Server) restoreRooms() error {
+	rooms, err := s.getJoinedRooms()
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rooms {
+		s.discovery.AddRoom(r.Room)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/text/unicode/norm"
+)
+
+func TestRestoreRooms(t *testing.T) {
+	config := Config{
+		DBPath:    filepath.Join(t.TempDir(), "test.db"),
+		Discovery: NewMemoryRegistry().NewDiscovery,
+	}
+
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	for _, room := range []string{"left", "kept"} {
+		if _, err := s.joinRoom(room); err != nil {
+			t.Fatalf("failed to join room: %v", err)
+		}
+	}
+	if _, err := s.leaveRoom("left"); err != nil {
+		t.Fatalf("failed to leave room: %v", err)
+	}
+	s.Close()
+
+	s, err = NewServer(config)
+	if err != nil {
+		t.Fatalf("failed to restart server: %v", err)
+	}
+	defer s.Close()
+
+	// rooms are restored when the server starts listening
+	if err := s.restoreRooms(); err != nil {
+		t.Fatalf("failed to restore rooms: %v", err)
+	}
+	if !s.discovery.IsMember("kept") || s.discovery.IsMember("left") {
+		t.Errorf("expected only to be in room kept after restarting, got %v", s.discovery.Membership())
+	}
+}
+
+func TestNormalizeRoomName(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		normalized string
+		valid      bool
+	}{
+		{"test", "test", true},
+		{"  lots   of\tspace ", "lots of space", true},
+		{"caf\u00e9", "caf\u00e9", true},
+		{"cafe\u0301", "caf\u00e9", true},
+		{".", "", false},
+		{"..", "", false},
+		{"", "", false},
+		{"   ", "", false},
+		{"room/name", "", false},
+		{"\x00", "", false},
+		{"\xff", "", false},
+		{strings.Repeat("x", maxRoomNameLength), strings.Repeat("x", maxRoomNameLength), true},
+		{strings.Repeat("x", maxRoomNameLength+1), "", false},
+	} {
+		n, err := normalizeRoomName(c.name)
+		if (err == nil) != c.valid || n != c.normalized {
+			t.Errorf("%q: expected %q (valid %v), got %q (error %v)", c.name, c.normalized, c.valid, n, err)
+		}
+		if validRoomName(c.name) != (c.valid && c.name == c.normalized) {
+			t.Errorf("%q: expected valid to be %v", c.name, c.valid && c.name == c.normalized)
+		}
+	}
+}
+
+var roomNameSeeds = []string{
+	"test",
+	"  lots   of\tspace ",
+	"caf\u00e9",
+	"cafe\u0301",
+	".",
+	"..",
+	"100%",
+	"a?b#c",
+	"room/name",
+	"\\",
+	"\x00",
+	"\xff",
+	strings.Repeat("x", maxRoomNameLength+1),
+}
+
+func FuzzNormalizeRoomName(f *testing.F) {
+	for _, s := range roomNameSeeds {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, name string) {
+		n, err := normalizeRoomName(name)
+		if err != nil {
+			return
+		}
+
+		if !utf8.ValidString(n) || !norm.NFC.IsNormalString(n) {
+			t.Errorf("%q was normalized to %q, which isn't valid NFC UTF-8", name, n)
+		}
+		if n == "" || len(n) > maxRoomNameLength || strings.Contains(n, "/") {
+			t.Errorf("%q was normalized to invalid room name %q", name, n)
+		}
+		if !validRoomName(n) {
+			t.Errorf("%q was normalized to %q, which isn't in canonical form", name, n)
+		}
+	})
+}
+
+func FuzzRoomPathRoundTrip(f *testing.F) {
+	for _, s := range roomNameSeeds {
+		f.Add(s)
+	}
+
+	var got string
+	r := mux.NewRouter()
+	r.HandleFunc("/rooms/{room}/message", func(w http.ResponseWriter, r *http.Request) {
+		got = mux.Vars(r)["room"]
+	})
+
+	f.Fuzz(func(t *testing.T, name string) {
+		if !validRoomName(name) {
+			return
+		}
+
+		got = ""
+		path := fmt.Sprintf("/rooms/%v/message", url.PathEscape(name))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://localhost"+path, nil))
+		if w.Code != http.StatusOK || got != name {
+			t.Errorf("room %q was routed with HTTP %v as %q", name, w.Code, got)
+		}
+	})
+}
@@ -24,11 +24,18 @@ import (
 const rsaBits int = 2048
 const certValidity = 365 * 24 * time.Hour
 
+// DefaultDiscoveryExpiry is the number of missed discovery intervals after which a peer is forgotten if not configured
+const DefaultDiscoveryExpiry = 3
+
 type key int
 
 const (
 	keyServer key = iota
 	keyUser
+	// keyStream is the stream a request was received over (if any)
+	keyStream
+	// keyConnState is the TLS state of the QUIC connection a request was received over
+	keyConnState
 )
 
 func writeAccessLog(t string) func(w io.Writer, params handlers.LogFormatterParams) {
@@ -58,8 +65,50 @@ func userMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// roomMiddleware normalizes the room name in a request's path, rejecting the request if the name is invalid
+func roomMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if room, ok := vars["room"]; ok {
+			normalized, err := normalizeRoomName(room)
+			if err != nil {
+				JSONErrResponse(w, fmt.Errorf("invalid room name: %w", err), http.StatusBadRequest)
+				return
+			}
+
+			vars["room"] = normalized
+			r = mux.SetURLVars(r, vars)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Config represents the configuration for a Server
+type Config struct {
+	// DBPath is the path to the SQLite database
+	DBPath string
+	// DiscoveryExpiry is the number of missed discovery intervals after which a peer is forgotten
+	// (DefaultDiscoveryExpiry if not positive)
+	DiscoveryExpiry int
+	// Discovery creates the discovery backend for the server's UUID (mDNS is used if nil)
+	Discovery func(id uuid.UUID) Discovery
+	// StaticPeers are addresses (host:port) of peers to add in addition to those already stored
+	StaticPeers []string
+	// RendezvousNodes are addresses (host:port) of rendezvous nodes to register with and find peers through
+	RendezvousNodes []string
+	// RendezvousServer makes this node act as a rendezvous node for others
+	RendezvousServer bool
+	// QUIC enables the QUIC transport for the peer API (alongside TCP)
+	QUIC bool
+	// QUICLoss is the proportion of outgoing QUIC packets to drop, to simulate a lossy link
+	QUICLoss float64
+}
+
 // Server is a CryptoChat server
 type Server struct {
+	id uuid.UUID
+
 	db    *sql.DB
 	stmts sqlStmts
 
@@ -73,17 +122,53 @@ type Server struct {
 	verification     map[uuid.UUID]chan struct{}
 
 	discovery Discovery
-	client    *http.Client
+	static    *staticDiscovery
+	// rendezvous is the registry of nodes registered with this one (if acting as a rendezvous node)
+	rendezvous *rendezvousRegistry
+	auth       *roomAuth
+	relays     *seenCache
+	kicks      *seenCache
+	peerCaps   *capabilityCache
+	client     *http.Client
+	streams    *streamManager
+	// quic is the QUIC transport (if enabled)
+	quic *quicTransport
+
+	// clockLock ensures messages sent by this user are assigned distinct clock values
+	clockLock sync.Mutex
+
+	typingSend, typingReceive *rateLimiter
+
+	quit chan struct{}
+}
+
+// addRoomRoutes adds the room endpoints of the peer API to a router
+func (s *Server) addRoomRoutes(r *mux.Router) {
+	r.HandleFunc("/rooms/{room}/challenge", s.apiChallenge).Methods(http.MethodPost)
+	r.HandleFunc("/rooms/{room}/prove", s.apiProve).Methods(http.MethodPost)
+	r.HandleFunc("/rooms/{room}/manifest", s.apiManifest).Methods(http.MethodPut)
+	r.HandleFunc("/rooms/{room}/kick", s.apiKick).Methods(http.MethodPost)
+	r.HandleFunc("/rooms/{room}/metadata", s.apiMetadata).Methods(http.MethodPut)
+	r.HandleFunc("/rooms/{room}/message", s.apiSendMessage).Methods(http.MethodPost)
+	r.HandleFunc("/rooms/{room}/relay", s.apiRelay).Methods(http.MethodPost)
+	r.HandleFunc("/rooms/{room}/history", s.apiHistory).Methods(http.MethodGet)
+	r.HandleFunc("/rooms/{room}/typing", s.apiTyping).Methods(http.MethodPost)
+	r.HandleFunc("/rooms/{room}/read", s.apiReadReceipt).Methods(http.MethodPost)
+	r.HandleFunc("/rooms/{room}/messages/{id}", s.apiEditMessage).Methods(http.MethodPut, http.MethodDelete)
+	r.HandleFunc("/rooms/{room}/messages/{id}/reactions/{emoji}", s.apiReact).Methods(http.MethodPut, http.MethodDelete)
 }
 
 // NewServer creates a new Server
-func NewServer(dbPath string) (*Server, error) {
+func NewServer(config Config) (*Server, error) {
+	dbPath := config.DBPath
+
 	oldMask := -1
 	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
 		oldMask = unix.Umask(0066)
 	}
 
-	db, err := sql.Open("sqlite3", dbPath)
+	// secure deletion overwrites deleted content (e.g. expired messages) with zeroes
+	db, err := sql.Open("sqlite3", dbPath+"?_secure_delete=true&_foreign_keys=true")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -91,8 +176,21 @@ func NewServer(dbPath string) (*Server, error) {
 		db: db,
 
 		verification: make(map[uuid.UUID]chan struct{}),
+
+		auth:     newRoomAuth(),
+		relays:   newSeenCache(relaySeenExpiry),
+		kicks:    newSeenCache(kickSeenExpiry),
+		peerCaps: newCapabilityCache(),
+
+		typingSend:    newRateLimiter(typingInterval),
+		typingReceive: newRateLimiter(typingInterval),
+
+		quit: make(chan struct{}),
 	}
 
+	if err := s.dbCreateTables(); err != nil {
+		return nil, fmt.Errorf("failed to initialize database: %w", err)
+	}
 	if oldMask != -1 {
 		if err := s.dbInit(); err != nil {
 			return nil, fmt.Errorf("failed to initialize database: %w", err)
@@ -114,14 +212,29 @@ func NewServer(dbPath string) (*Server, error) {
 		return nil, fmt.Errorf("failed to parse UUID on internal certificate: %w", err)
 	}
 
+	s.id = id
+
 	log.WithFields(log.Fields{
 		"uuid":        id,
 		"fingerprint": GetCertFingerprint(cert.Leaf),
 	}).Info("Loaded server certificate")
 
 	apiRouter := mux.NewRouter()
-	apiRouter.Use(userMiddleware)
-	apiRouter.HandleFunc("/rooms/{room}/message", s.apiSendMessage).Methods(http.MethodPost)
+	apiRouter.Use(userMiddleware, roomMiddleware)
+	apiRouter.HandleFunc("/info", s.apiInfo).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/capabilities", s.apiCapabilities).Methods(http.MethodGet)
+	// peers which don't advertise a protocol version use the unversioned paths
+	s.addRoomRoutes(apiRouter)
+	versioned := apiRouter.PathPrefix(versionedPath(protocolVersion, "")).Subrouter()
+	s.addRoomRoutes(versioned)
+	versioned.HandleFunc("/stream", s.apiStream).Methods(http.MethodGet)
+
+	if config.RendezvousServer {
+		s.rendezvous = newRendezvousRegistry()
+		apiRouter.HandleFunc("/rendezvous/registration", s.apiRendezvousRegister).
+			Methods(http.MethodPut, http.MethodDelete)
+		apiRouter.HandleFunc("/rendezvous/peers", s.apiRendezvousPeers).Methods(http.MethodGet)
+	}
 
 	s.api = http.Server{
 		TLSConfig: &tls.Config{
@@ -136,19 +249,47 @@ func NewServer(dbPath string) (*Server, error) {
 		Handler: handlers.CustomLoggingHandler(nil, apiRouter, writeAccessLog("api")),
 	}
 	s.cert = &s.api.TLSConfig.Certificates[0]
+	if config.QUIC {
+		s.quic = newQUICTransport(&s, config.QUICLoss)
+	}
 
 	uiRouter := mux.NewRouter()
 
 	uiAPI := uiRouter.PathPrefix("/api").Subrouter()
+	uiAPI.Use(roomMiddleware)
 	uiAPI.HandleFunc("/info", s.uiInfo).Methods(http.MethodGet)
 	uiAPI.HandleFunc("/users/{uuid}/verify", s.uiVerifyUser).Methods(http.MethodPost, http.MethodDelete)
+	uiAPI.HandleFunc("/presence", s.uiPresence).Methods(http.MethodGet, http.MethodPut)
+	uiAPI.HandleFunc("/settings", s.uiSettings).Methods(http.MethodGet, http.MethodPut)
+	uiAPI.HandleFunc("/unread", s.uiUnread).Methods(http.MethodGet)
+	uiAPI.HandleFunc("/peers", s.uiStaticPeers).Methods(http.MethodGet, http.MethodPost)
+	uiAPI.HandleFunc("/peers/{address}", s.uiStaticPeerRemove).Methods(http.MethodDelete)
 	uiAPI.HandleFunc("/rooms", s.uiRooms).Methods(http.MethodGet)
-	uiAPI.HandleFunc("/rooms/{room}", s.uiRoomEdit).Methods(http.MethodPost, http.MethodDelete)
+	uiAPI.HandleFunc("/rooms/{room}", s.uiRoomEdit).Methods(http.MethodPut, http.MethodPost, http.MethodDelete)
+	uiAPI.HandleFunc("/rooms/{room}/settings", s.uiRoomSettings).Methods(http.MethodGet, http.MethodPut)
+	uiAPI.HandleFunc("/rooms/{room}/secret", s.uiRoomSecret).Methods(http.MethodGet, http.MethodPut, http.MethodDelete)
+	uiAPI.HandleFunc("/rooms/{room}/invites", s.uiCreateInvite).Methods(http.MethodPost)
+	uiAPI.HandleFunc("/rooms/{room}/manifest", s.uiManifest).Methods(http.MethodGet, http.MethodPut)
+	uiAPI.HandleFunc("/rooms/{room}/metadata", s.uiMetadata).Methods(http.MethodGet, http.MethodPut)
+	uiAPI.HandleFunc("/rooms/{room}/members/{uuid}/kick", s.uiKick).Methods(http.MethodPost)
+	uiAPI.HandleFunc("/rooms/{room}/bans/{uuid}", s.uiBan).Methods(http.MethodPut, http.MethodDelete)
+	uiAPI.HandleFunc("/invites", s.uiRedeemInvite).Methods(http.MethodPost)
 	uiAPI.HandleFunc("/rooms/{room}/message", s.uiSendMessage).Methods(http.MethodPost)
+	uiAPI.HandleFunc("/rooms/{room}/typing", s.uiTyping).Methods(http.MethodPost)
+	uiAPI.HandleFunc("/rooms/{room}/read", s.uiMarkRead).Methods(http.MethodPut)
+	uiAPI.HandleFunc("/rooms/{room}/messages", s.uiRoomHistory).Methods(http.MethodGet)
+	uiAPI.HandleFunc("/rooms/{room}/messages/{id}", s.uiMessageEdit).Methods(http.MethodPut, http.MethodDelete)
+	uiAPI.HandleFunc("/rooms/{room}/messages/{id}/edits", s.uiMessageEdits).Methods(http.MethodGet)
+	uiAPI.HandleFunc("/rooms/{room}/messages/{id}/thread", s.uiThread).Methods(http.MethodGet)
+	uiAPI.HandleFunc("/rooms/{room}/messages/{id}/receipts", s.uiReadReceipts).Methods(http.MethodGet)
+	uiAPI.HandleFunc("/rooms/{room}/messages/{id}/reactions/{emoji}", s.uiReact).
+		Methods(http.MethodPut, http.MethodDelete)
 
 	s.events = sse.New()
 	s.events.CreateStream(streamVerification)
 	s.events.CreateStream(streamMessages)
+	s.events.CreateStream(streamPresence)
+	s.events.CreateStream(streamRooms)
 	uiAPI.HandleFunc("/events", s.events.HTTPHandler).Methods(http.MethodGet)
 
 	uiRouter.PathPrefix("/").Handler(newSPAHandler())
@@ -157,18 +298,91 @@ func NewServer(dbPath string) (*Server, error) {
 		Handler: handlers.CustomLoggingHandler(nil, uiRouter, writeAccessLog("ui")),
 	}
 
-	s.discovery = NewDiscovery(id)
+	presence, err := s.loadPresence()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load presence: %w", err)
+	}
 
+	var primary Discovery
+	if config.Discovery != nil {
+		primary = config.Discovery(id)
+	} else {
+		expiry := config.DiscoveryExpiry
+		if expiry <= 0 {
+			expiry = DefaultDiscoveryExpiry
+		}
+		primary = NewMDNSDiscovery(id, expiry)
+	}
+	s.static = newStaticDiscovery()
+	backends := multiDiscovery{primary, s.static}
+	if s.rendezvous != nil {
+		backends = append(backends, s.rendezvous)
+	}
+	var rendezvous *rendezvousDiscovery
+	if len(config.RendezvousNodes) != 0 {
+		rendezvous = newRendezvousDiscovery(id, config.RendezvousNodes)
+		backends = append(backends, rendezvous)
+	}
+	s.discovery = backends
+	s.discovery.SetPresence(presence)
+	if err := s.loadRoomSecrets(); err != nil {
+		return nil, err
+	}
+	events, _ := s.discovery.Subscribe()
+	go s.publishDiscoveryEvents(events)
+	stateEvents, _ := s.discovery.Subscribe()
+	go s.pushRoomState(stateEvents)
+	historyEvents, _ := s.discovery.Subscribe()
+	go s.syncHistoryOnJoin(historyEvents)
+
+	dialer := newPeerDialer(s.discovery)
+	clientTLS := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: s.verifyPeer,
+		VerifyConnection:      verifyDialedPeer,
+	}
 	s.client = &http.Client{
 		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				Certificates: []tls.Certificate{cert},
-
-				InsecureSkipVerify:    true,
-				VerifyPeerCertificate: s.verifyPeer,
-			},
+			DialContext:     dialer.DialContext,
+			TLSClientConfig: clientTLS,
 		},
 	}
+	s.streams = newStreamManager(id, dialer, clientTLS)
+
+	s.static.client = s.client
+	if d, ok := primary.(*MDNSDiscovery); ok {
+		d.client = s.client
+	}
+	if rendezvous != nil {
+		rendezvous.client = &http.Client{
+			Transport: s.client.Transport,
+			Timeout:   rendezvousTimeout,
+		}
+
+		for _, addr := range config.RendezvousNodes {
+			if err := validStaticPeer(addr); err != nil {
+				return nil, fmt.Errorf("invalid rendezvous node address: %w", err)
+			}
+
+			// the rendezvous node's own rooms are found by probing it like any other static peer
+			s.static.AddPeer(addr)
+		}
+	}
+
+	staticPeers, err := s.getStaticPeers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load static peers: %w", err)
+	}
+	for _, addr := range staticPeers {
+		s.static.AddPeer(addr)
+	}
+	for _, addr := range config.StaticPeers {
+		if _, err := s.addStaticPeer(addr); err != nil {
+			return nil, err
+		}
+	}
 
 	return &s, nil
 }
@@ -188,11 +402,27 @@ func (s *Server) Listen(addr, uiAddr string) error {
 		return fmt.Errorf("failed to start UI TCP listener: %w", err)
 	}
 
+	apiAddr := apiListener.Addr().(*net.TCPAddr)
+	quicPort := 0
+	if s.quic != nil {
+		host, _, _ := net.SplitHostPort(addr)
+		if err := s.quic.listen(host, apiAddr.Port); err != nil {
+			return err
+		}
+		quicPort = s.quic.port()
+	}
+
 	log.WithFields(log.Fields{
-		"api": apiListener.Addr(),
-		"ui":  uiListener.Addr(),
+		"api":  apiAddr,
+		"ui":   uiListener.Addr(),
+		"quic": quicPort,
 	}).Info("Server now listening")
 
+	if err := s.restoreRooms(); err != nil {
+		return err
+	}
+	go s.sweepExpired(s.quit)
+
 	errCh := make(chan error)
 	go func() {
 		errCh <- s.api.ServeTLS(apiListener, "", "")
@@ -202,9 +432,13 @@ func (s *Server) Listen(addr, uiAddr string) error {
 		errCh <- s.ui.Serve(uiListener)
 		s.ui.Close()
 	}()
+	if s.quic != nil {
+		go func() {
+			errCh <- s.quic.serve()
+		}()
+	}
 	go func() {
-		errCh <- s.discovery.Start(apiListener.Addr().(*net.TCPAddr).Port)
-		s.discovery.Close()
+		errCh <- s.discovery.Start(apiAddr.Port, quicPort)
 	}()
 
 	if err := <-errCh; err != http.ErrServerClosed {
@@ -216,6 +450,14 @@ func (s *Server) Listen(addr, uiAddr string) error {
 
 // Close ends listening
 func (s *Server) Close() error {
+	close(s.quit)
+	s.streams.closeAll()
+	if s.quic != nil {
+		s.quic.close()
+	}
+	if err := s.discovery.Close(); err != nil {
+		return fmt.Errorf("failed to close discovery: %w", err)
+	}
 	s.events.Close()
 	if err := s.ui.Close(); err != nil {
 		return fmt.Errorf("failed to close frontend server: %w", err)
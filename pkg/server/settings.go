@@ -0,0 +1,75 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Settings represents user-configurable behaviour of the server
+type Settings struct {
+	// ReadReceipts enables sending read receipts to room members
+	ReadReceipts bool `json:"read_receipts"`
+	// Relay enables forwarding messages to room members which other members cannot reach directly
+	Relay bool `json:"relay"`
+	// ShareHistory enables sharing recent signed room history with verified members who request it
+	ShareHistory bool `json:"share_history"`
+}
+
+func defaultSettings() Settings {
+	return Settings{
+		ReadReceipts: false,
+		Relay:        false,
+		ShareHistory: false,
+	}
+}
+
+func (s *Server) loadSettings() (Settings, error) {
+	settings := defaultSettings()
+
+	data, err := s.getSetting("settings")
+	if err != nil || data == nil {
+		return settings, err
+	}
+
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return settings, fmt.Errorf("failed to parse stored settings: %w", err)
+	}
+	return settings, nil
+}
+
+func (s *Server) saveSettings(settings Settings) error {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("failed to encode settings: %w", err)
+	}
+
+	return s.setSetting("settings", data)
+}
+
+// RoomSettings represents user-configurable behaviour of a single room
+type RoomSettings struct {
+	// TTL is the default number of seconds after which messages sent to the room expire (0 for never)
+	TTL int `json:"ttl"`
+	// Muted rooms don't count towards unread messages
+	Muted bool `json:"muted"`
+}
+
+func (s *Server) loadRoomSettings(room string) (RoomSettings, error) {
+	var settings RoomSettings
+	if err := s.stmts.getRoomSettings.QueryRow(room).Scan(&settings.TTL, &settings.Muted); err != nil &&
+		!errors.Is(err, sql.ErrNoRows) {
+		return settings, fmt.Errorf("failed to retrieve room settings from database: %w", err)
+	}
+
+	return settings, nil
+}
+
+func (s *Server) saveRoomSettings(room string, settings RoomSettings) error {
+	if _, err := s.stmts.setRoomSettings.Exec(room, settings.TTL, settings.Muted); err != nil {
+		return fmt.Errorf("failed to update room settings in database: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,329 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const staticProbeInterval = 15 * time.Second
+const staticProbeTimeout = 10 * time.Second
+
+// apiPeerInfo describes a user to peers (used to probe static peers)
+type apiPeerInfo struct {
+	UUID string `json:"uuid"`
+	// Version is the peer API protocol version spoken by the user (0 if not advertised)
+	Version int `json:"version,omitempty"`
+	// QUICPort is the UDP port the user accepts QUIC connections on (0 if it doesn't)
+	QUICPort int      `json:"quic_port,omitempty"`
+	Rooms    []string `json:"rooms"`
+	// PrivateRooms are the tags of the private rooms the user is in
+	PrivateRooms []string `json:"private_rooms"`
+	Presence     Presence `json:"presence"`
+}
+
+// StaticPeer represents a peer added manually by address
+type StaticPeer struct {
+	Address string `json:"address"`
+	// UUID is the peer's UUID as of the last successful probe (or uuid.Nil)
+	UUID     uuid.UUID `json:"uuid"`
+	LastSeen time.Time `json:"last_seen"`
+	// Error is the reason the last probe failed (if it did)
+	Error string `json:"error,omitempty"`
+}
+
+// validStaticPeer checks that an address is of the form host:port
+func validStaticPeer(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return fmt.Errorf("invalid port %v", port)
+	}
+	return nil
+}
+
+// staticDiscovery finds peers by periodically probing a list of manually added addresses, allowing peers outside the
+// local multicast domain to be reached
+type staticDiscovery struct {
+	peerTable
+
+	client *http.Client
+
+	peersLock sync.Mutex
+	peers     map[string]*StaticPeer
+
+	probe chan string
+	quit  chan struct{}
+}
+
+func newStaticDiscovery() *staticDiscovery {
+	return &staticDiscovery{
+		peerTable: newPeerTable(),
+
+		peers: make(map[string]*StaticPeer),
+
+		probe: make(chan string, 16),
+		quit:  make(chan struct{}),
+	}
+}
+
+// AddPeer adds an address to be probed, returning false if it was already present
+func (d *staticDiscovery) AddPeer(addr string) bool {
+	d.peersLock.Lock()
+	defer d.peersLock.Unlock()
+
+	if _, ok := d.peers[addr]; ok {
+		return false
+	}
+
+	d.peers[addr] = &StaticPeer{Address: addr}
+	select {
+	case d.probe <- addr:
+	default:
+		// will be probed on the next interval
+	}
+	return true
+}
+
+// RemovePeer stops probing an address, returning false if it was not present
+func (d *staticDiscovery) RemovePeer(addr string) bool {
+	d.peersLock.Lock()
+	p, ok := d.peers[addr]
+	delete(d.peers, addr)
+	d.peersLock.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	if p.UUID != uuid.Nil {
+		d.removeMember(p.UUID)
+	}
+	return true
+}
+
+// Peers retrieves the list of static peers and their status
+func (d *staticDiscovery) Peers() []StaticPeer {
+	d.peersLock.Lock()
+	defer d.peersLock.Unlock()
+
+	peers := make([]StaticPeer, 0, len(d.peers))
+	for _, p := range d.peers {
+		peers = append(peers, *p)
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Address < peers[j].Address
+	})
+	return peers
+}
+
+// fetchPeerInfo asks the peer at `addr` for its UUID and rooms
+func fetchPeerInfo(client *http.Client, addr string) (apiPeerInfo, uuid.UUID, error) {
+	var info apiPeerInfo
+
+	ctx, cancel := context.WithTimeout(context.Background(), staticProbeTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("https://%v/info", addr), nil)
+	if err != nil {
+		return info, uuid.Nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return info, uuid.Nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return info, uuid.Nil, fmt.Errorf("peer returned status %v", res.StatusCode)
+	}
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return info, uuid.Nil, fmt.Errorf("failed to parse peer info: %w", err)
+	}
+
+	id, err := uuid.Parse(info.UUID)
+	if err != nil {
+		return info, uuid.Nil, fmt.Errorf("failed to parse peer UUID: %w", err)
+	}
+	// the UUID is only trustworthy if it matches the (verified) certificate
+	if res.TLS == nil || len(res.TLS.PeerCertificates) == 0 ||
+		res.TLS.PeerCertificates[0].Subject.CommonName != id.String() {
+		return info, uuid.Nil, errors.New("peer UUID does not match certificate")
+	}
+
+	return info, id, nil
+}
+
+// probePeer updates the rooms of the peer at `addr`
+func (d *staticDiscovery) probePeer(addr string) {
+	info, id, err := fetchPeerInfo(d.client, addr)
+
+	var addrs []net.IP
+	host, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
+	if err == nil {
+		if addrs, err = net.LookupIP(host); err != nil {
+			err = fmt.Errorf("failed to resolve peer address: %w", err)
+		}
+	}
+
+	d.peersLock.Lock()
+	p, ok := d.peers[addr]
+	if !ok {
+		// removed while probing
+		d.peersLock.Unlock()
+		return
+	}
+
+	old := p.UUID
+	if err != nil {
+		p.UUID = uuid.Nil
+		p.Error = err.Error()
+	} else {
+		p.UUID = id
+		p.LastSeen = time.Now()
+		p.Error = ""
+	}
+	d.peersLock.Unlock()
+
+	if old != uuid.Nil && old != p.UUID {
+		d.removeMember(old)
+	}
+	if err != nil {
+		log.WithError(err).WithField("address", addr).Debug("Failed to probe static peer")
+		return
+	}
+
+	member := RoomMember{
+		UUID:     id,
+		Addrs:    addrs,
+		Port:     port,
+		Version:  info.Version,
+		QUICPort: info.QUICPort,
+		Presence: info.Presence,
+		LastSeen: time.Now(),
+	}
+	if err := member.Presence.validate(); err != nil {
+		member.Presence = Presence{Status: StatusOnline}
+	}
+
+	d.updateMember(member, roomAdvert{
+		Rooms:   info.Rooms,
+		Private: info.PrivateRooms,
+	})
+}
+
+func (d *staticDiscovery) probeAll() {
+	d.peersLock.Lock()
+	addrs := make([]string, 0, len(d.peers))
+	for addr := range d.peers {
+		addrs = append(addrs, addr)
+	}
+	d.peersLock.Unlock()
+
+	for _, addr := range addrs {
+		go d.probePeer(addr)
+	}
+}
+
+// Start probes the static peers periodically until Close is called
+func (d *staticDiscovery) Start(apiPort, quicPort int) error {
+	d.probeAll()
+
+	t := time.NewTicker(staticProbeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			d.probeAll()
+		case addr := <-d.probe:
+			go d.probePeer(addr)
+		case <-d.quit:
+			return nil
+		}
+	}
+}
+
+// Close stops probing static peers
+func (d *staticDiscovery) Close() error {
+	close(d.quit)
+	d.events.close()
+
+	return nil
+}
+
+// SetPresence updates the presence of this user (static peers probe us for it)
+func (d *staticDiscovery) SetPresence(p Presence) {
+	d.setPresence(p)
+}
+
+// SetRoomSecret makes a room private, advertising it by a tag derived from `secret` (or public if nil)
+func (d *staticDiscovery) SetRoomSecret(room string, secret []byte) {
+	d.setRoomSecret(room, secret)
+}
+
+// AddRoom adds a room to the list of rooms this user is in
+func (d *staticDiscovery) AddRoom(room string) bool {
+	return d.addRoom(room)
+}
+
+// RemoveRoom removes a room from the list of rooms this user is in
+func (d *staticDiscovery) RemoveRoom(room string) bool {
+	return d.removeRoom(room)
+}
+
+func (s *Server) getStaticPeers() ([]string, error) {
+	rows, err := s.stmts.staticPeers.Query()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database for static peers: %w", err)
+	}
+	defer rows.Close()
+
+	addrs := []string{}
+	for rows.Next() {
+		var addr string
+		if err := rows.Scan(&addr); err != nil {
+			return nil, fmt.Errorf("failed to read static peer from query result: %w", err)
+		}
+
+		addrs = append(addrs, addr)
+	}
+
+	return addrs, rows.Err()
+}
+
+// addStaticPeer persists a static peer and starts probing it
+func (s *Server) addStaticPeer(addr string) (bool, error) {
+	if err := validStaticPeer(addr); err != nil {
+		return false, fmt.Errorf("invalid peer address: %w", err)
+	}
+
+	if _, err := s.stmts.addStaticPeer.Exec(addr); err != nil {
+		return false, fmt.Errorf("failed to add static peer to database: %w", err)
+	}
+
+	return s.static.AddPeer(addr), nil
+}
+
+func (s *Server) removeStaticPeer(addr string) (bool, error) {
+	if _, err := s.stmts.removeStaticPeer.Exec(addr); err != nil {
+		return false, fmt.Errorf("failed to remove static peer from database: %w", err)
+	}
+
+	return s.static.RemovePeer(addr), nil
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidStaticPeer(t *testing.T) {
+	for _, c := range []struct {
+		addr  string
+		valid bool
+	}{
+		{"192.0.2.1:1234", true},
+		{"[2001:db8::1]:1234", true},
+		{"example.com:443", true},
+		{"192.0.2.1", false},
+		{"192.0.2.1:0", false},
+		{"192.0.2.1:65536", false},
+		{"192.0.2.1:http", false},
+	} {
+		if err := validStaticPeer(c.addr); (err == nil) != c.valid {
+			t.Errorf("%v: expected valid to be %v, got error %v", c.addr, c.valid, err)
+		}
+	}
+}
+
+func TestStaticPeer(t *testing.T) {
+	// the servers can only find each other by address
+	a := newTestServer(t, NewMemoryRegistry())
+	b := newTestServer(t, NewMemoryRegistry())
+	trust(t, a, b)
+	uiRequest(t, b, http.MethodPost, "/api/rooms/test", "")
+
+	api := httptest.NewUnstartedServer(b.api.Handler)
+	api.Config.BaseContext = b.api.BaseContext
+	api.TLS = b.api.TLSConfig
+	api.StartTLS()
+	defer api.Close()
+
+	a.static.AddPeer(api.Listener.Addr().String())
+	eventually(t, "static peer to be probed", func() bool {
+		return inRoom(a, "test", b)
+	})
+
+	peers := a.static.Peers()
+	if len(peers) != 1 || peers[0].UUID != b.id || peers[0].Error != "" {
+		t.Errorf("expected static peer to be %v, got %+v", b.id, peers)
+	}
+}
@@ -0,0 +1,463 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// streamPingInterval is how often the peer at the other end of a stream is checked for liveness
+const streamPingInterval = 15 * time.Second
+
+// streamTimeout is how long a stream can go without hearing from the peer before it is closed
+const streamTimeout = 2 * streamPingInterval
+
+// streamRequestTimeout is how long to wait for the response to a request made over a stream
+const streamRequestTimeout = 30 * time.Second
+
+// streamMaxInFlight is how many requests from the peer can be handled at once over a stream (reading further frames
+// waits until one of them finishes)
+const streamMaxInFlight = 32
+
+// streamRetryDelay is how long to wait before trying to open a stream to a peer again after failing to
+const streamRetryDelay = time.Minute
+
+// errStreamUnavailable means a request couldn't be made over a stream (and should be made over HTTP instead)
+var errStreamUnavailable = errors.New("stream unavailable")
+
+var streamUpgrader = websocket.Upgrader{}
+
+// streamFrame is a request or response carried over a stream (responses have a non-zero status)
+type streamFrame struct {
+	ID     uint64          `json:"id"`
+	Method string          `json:"method,omitempty"`
+	Path   string          `json:"path,omitempty"`
+	Status int             `json:"status,omitempty"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// streamResponseWriter collects the response to a request received over a stream
+type streamResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *streamResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *streamResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.body.Write(b)
+}
+
+func (w *streamResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// peerStream is a persistent WebSocket connection to a peer, over which either end can make requests to the other's
+// peer API
+type peerStream struct {
+	s    *Server
+	peer uuid.UUID
+	// opener is the UUID of the end which opened the stream
+	opener uuid.UUID
+	conn   *websocket.Conn
+	tls    tls.ConnectionState
+
+	writeLock sync.Mutex
+	// inFlight has a slot taken by each request from the peer which is being handled
+	inFlight chan struct{}
+
+	pendingLock sync.Mutex
+	nextID      uint64
+	pending     map[uint64]chan streamFrame
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newPeerStream(s *Server, peer, opener uuid.UUID, conn *websocket.Conn, state tls.ConnectionState) *peerStream {
+	return &peerStream{
+		s:      s,
+		peer:   peer,
+		opener: opener,
+		conn:   conn,
+		tls:    state,
+
+		inFlight: make(chan struct{}, streamMaxInFlight),
+		pending:  make(map[uint64]chan streamFrame),
+
+		closed: make(chan struct{}),
+	}
+}
+
+func (st *peerStream) write(f streamFrame) error {
+	st.writeLock.Lock()
+	defer st.writeLock.Unlock()
+
+	st.conn.SetWriteDeadline(time.Now().Add(streamTimeout))
+	return st.conn.WriteJSON(f)
+}
+
+// run handles frames from the peer and checks that it is still alive until the stream is closed
+func (st *peerStream) run() {
+	defer st.close()
+
+	st.conn.SetReadDeadline(time.Now().Add(streamTimeout))
+	st.conn.SetPongHandler(func(string) error {
+		return st.conn.SetReadDeadline(time.Now().Add(streamTimeout))
+	})
+	go st.ping()
+
+	for {
+		var f streamFrame
+		if err := st.conn.ReadJSON(&f); err != nil {
+			select {
+			case <-st.closed:
+				// closed by this end
+			default:
+				if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					log.WithField("id", st.peer).WithError(err).Debug("Peer stream failed")
+				}
+			}
+			return
+		}
+		st.conn.SetReadDeadline(time.Now().Add(streamTimeout))
+
+		if f.Status == 0 {
+			select {
+			case st.inFlight <- struct{}{}:
+			case <-st.closed:
+				return
+			}
+
+			go func() {
+				defer func() { <-st.inFlight }()
+				st.serve(f)
+			}()
+			continue
+		}
+
+		st.pendingLock.Lock()
+		ch, ok := st.pending[f.ID]
+		delete(st.pending, f.ID)
+		st.pendingLock.Unlock()
+		if ok {
+			ch <- f
+		}
+	}
+}
+
+// ping checks that the peer is still responding until the stream is closed
+func (st *peerStream) ping() {
+	t := time.NewTicker(streamPingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := st.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamTimeout)); err != nil {
+				select {
+				case <-st.closed:
+				default:
+					log.WithField("id", st.peer).WithError(err).Debug("Failed to ping peer stream")
+					st.close()
+				}
+				return
+			}
+		case <-st.closed:
+			return
+		}
+	}
+}
+
+// serve handles a request from the peer as if it had been made over HTTP
+func (st *peerStream) serve(f streamFrame) {
+	ctx := context.WithValue(context.WithValue(context.Background(), keyServer, st.s), keyStream, st)
+	req, err := http.NewRequestWithContext(ctx, f.Method, f.Path, bytes.NewReader(f.Body))
+
+	w := &streamResponseWriter{header: make(http.Header)}
+	if err != nil {
+		JSONErrResponse(w, fmt.Errorf("failed to parse request: %w", err), http.StatusBadRequest)
+	} else {
+		req.RequestURI = f.Path
+		req.RemoteAddr = st.conn.RemoteAddr().String()
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "cryptochat-stream")
+		req.TLS = &st.tls
+
+		st.s.api.Handler.ServeHTTP(w, req)
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	res := streamFrame{
+		ID:     f.ID,
+		Status: w.status,
+	}
+	if w.body.Len() != 0 {
+		if json.Valid(w.body.Bytes()) {
+			res.Body = w.body.Bytes()
+		} else {
+			// e.g. the router's plain text "404 page not found"
+			res.Body, _ = json.Marshal(jsonError{Message: string(bytes.TrimSpace(w.body.Bytes()))})
+		}
+	}
+
+	if err := st.write(res); err != nil {
+		log.WithField("id", st.peer).WithError(err).Debug("Failed to send response over peer stream")
+		st.close()
+	}
+}
+
+// request makes a request to the peer's API over the stream, decoding the response into `res` (if not nil)
+func (st *peerStream) request(method, path string, body, res interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal body: %w", err)
+	}
+
+	ch := make(chan streamFrame, 1)
+	st.pendingLock.Lock()
+	st.nextID++
+	id := st.nextID
+	st.pending[id] = ch
+	st.pendingLock.Unlock()
+	defer func() {
+		st.pendingLock.Lock()
+		delete(st.pending, id)
+		st.pendingLock.Unlock()
+	}()
+
+	if err := st.write(streamFrame{
+		ID:     id,
+		Method: method,
+		Path:   path,
+		Body:   data,
+	}); err != nil {
+		st.close()
+		return fmt.Errorf("%w: failed to send request: %v", errStreamUnavailable, err)
+	}
+
+	t := time.NewTimer(streamRequestTimeout)
+	defer t.Stop()
+	select {
+	case f := <-ch:
+		return decodeJSONResponse(f.Status, bytes.NewReader(f.Body), res)
+	case <-st.closed:
+		return fmt.Errorf("%w: stream closed before response", errStreamUnavailable)
+	case <-t.C:
+		return errors.New("timed out waiting for response over peer stream")
+	}
+}
+
+func (st *peerStream) close() {
+	st.closeOnce.Do(func() {
+		close(st.closed)
+
+		st.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		st.conn.Close()
+
+		st.s.streams.remove(st)
+	})
+}
+
+// streamManager keeps track of the streams open to peers, opening new ones as needed
+type streamManager struct {
+	id      uuid.UUID
+	dialer  websocket.Dialer
+	lock    sync.Mutex
+	streams map[uuid.UUID]*peerStream
+	// dialing has a channel for each peer a stream is being opened to, which is closed once the attempt finishes
+	dialing map[uuid.UUID]chan struct{}
+	failed  map[uuid.UUID]time.Time
+}
+
+func newStreamManager(id uuid.UUID, dialer *peerDialer, tlsConfig *tls.Config) *streamManager {
+	return &streamManager{
+		id: id,
+		dialer: websocket.Dialer{
+			NetDialContext:   dialer.DialContext,
+			TLSClientConfig:  tlsConfig,
+			HandshakeTimeout: streamRequestTimeout,
+		},
+
+		streams: make(map[uuid.UUID]*peerStream),
+		dialing: make(map[uuid.UUID]chan struct{}),
+		failed:  make(map[uuid.UUID]time.Time),
+	}
+}
+
+// add starts using a newly opened stream, returning false if it was closed in favour of an existing one
+func (m *streamManager) add(st *peerStream) bool {
+	m.lock.Lock()
+	existing, ok := m.streams[st.peer]
+	// when both ends open a stream at the same time, the one opened by the end with the lower UUID is kept (so that
+	// both ends make the same choice); a stream reopened by the same end replaces the old one
+	keep := !ok || bytes.Compare(st.opener[:], existing.opener[:]) <= 0
+	if keep {
+		m.streams[st.peer] = st
+		delete(m.failed, st.peer)
+	}
+	m.lock.Unlock()
+
+	if !keep {
+		st.close()
+		return false
+	}
+
+	if ok {
+		existing.close()
+	}
+	go st.run()
+	return true
+}
+
+func (m *streamManager) remove(st *peerStream) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.streams[st.peer] == st {
+		delete(m.streams, st.peer)
+	}
+}
+
+// get retrieves the stream to a member, opening one if necessary
+func (m *streamManager) get(s *Server, member RoomMember) (*peerStream, error) {
+	for {
+		m.lock.Lock()
+		if st, ok := m.streams[member.UUID]; ok {
+			m.lock.Unlock()
+			return st, nil
+		}
+		if t, ok := m.failed[member.UUID]; ok && time.Since(t) < streamRetryDelay {
+			m.lock.Unlock()
+			return nil, errStreamUnavailable
+		}
+		if ch, ok := m.dialing[member.UUID]; ok {
+			m.lock.Unlock()
+			<-ch
+			continue
+		}
+
+		ch := make(chan struct{})
+		m.dialing[member.UUID] = ch
+		m.lock.Unlock()
+
+		err := m.open(s, member)
+
+		m.lock.Lock()
+		delete(m.dialing, member.UUID)
+		if err != nil {
+			m.failed[member.UUID] = time.Now()
+		}
+		m.lock.Unlock()
+		close(ch)
+
+		if err != nil {
+			log.WithField("id", member.UUID).WithError(err).Debug("Failed to open peer stream")
+			return nil, errStreamUnavailable
+		}
+	}
+}
+
+// open opens a stream to a member
+func (m *streamManager) open(s *Server, member RoomMember) error {
+	u := fmt.Sprintf("wss://%v%v", member.UUID, versionedPath(negotiateVersion(member.Version), "/stream"))
+	conn, _, err := m.dialer.Dial(u, nil)
+	if err != nil {
+		return err
+	}
+
+	tlsConn, ok := conn.UnderlyingConn().(*tls.Conn)
+	if !ok {
+		conn.Close()
+		return errors.New("stream is not using TLS")
+	}
+
+	// the stream is opened to whatever address the member is listed at, so make sure it really reached them
+	state := tlsConn.ConnectionState()
+	if cn := state.PeerCertificates[0].Subject.CommonName; cn != member.UUID.String() {
+		conn.Close()
+		return fmt.Errorf("peer presented certificate for %v", cn)
+	}
+
+	m.add(newPeerStream(s, member.UUID, m.id, conn, state))
+	return nil
+}
+
+// closeAll closes all open streams
+func (m *streamManager) closeAll() {
+	m.lock.Lock()
+	streams := make([]*peerStream, 0, len(m.streams))
+	for _, st := range m.streams {
+		streams = append(streams, st)
+	}
+	m.lock.Unlock()
+
+	for _, st := range streams {
+		st.close()
+	}
+}
+
+// peerRequest makes a request to a member's peer API, over QUIC or a stream if both ends support them (falling back to
+// a regular HTTP request if neither can be used)
+func (s *Server) peerRequest(m RoomMember, caps apiResCapabilities, method, path string, body, res interface{}) error {
+	path = versionedPath(negotiateVersion(m.Version), path)
+
+	if s.quic != nil && m.QUICPort != 0 {
+		err := s.quic.request(m, method, path, body, res)
+		if !errors.Is(err, errQUICUnavailable) {
+			return err
+		}
+	}
+
+	if caps.has(capStreams) {
+		st, err := s.streams.get(s, m)
+		if err == nil {
+			err = st.request(method, path, body, res)
+		}
+		if !errors.Is(err, errStreamUnavailable) {
+			return err
+		}
+	}
+
+	return JSONReq(s.client, method, peerURL(m.UUID, path), body, res)
+}
+
+// apiStream upgrades the connection to a stream, over which both ends can make requests to each other's peer API
+func (s *Server) apiStream(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value(keyUser).(User)
+
+	if r.Context().Value(keyStream) != nil {
+		JSONErrResponse(w, errors.New("streams cannot be opened over a stream"), http.StatusBadRequest)
+		return
+	}
+
+	conn, err := streamUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already responded
+		log.WithField("id", u.UUID).WithError(err).Debug("Failed to accept peer stream")
+		return
+	}
+
+	s.streams.add(newPeerStream(s, u.UUID, u.UUID, conn, *r.TLS))
+}
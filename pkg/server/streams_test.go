@@ -0,0 +1,154 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestStreamDelivery(t *testing.T) {
+	registry := NewMemoryRegistry()
+	a := newTestServer(t, registry)
+	b := newTestServer(t, registry)
+	trust(t, a, b)
+
+	// only b joins, so that it has no reason to open a stream of its own which could replace a's
+	uiRequest(t, b, http.MethodPost, "/api/rooms/test", "")
+	eventually(t, "member to be discovered", func() bool {
+		return inRoom(a, "test", b)
+	})
+	member, ok := a.discovery.Lookup(b.id)
+	if !ok {
+		t.Fatal("peer not found")
+	}
+
+	st, err := a.streams.get(a, member)
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+
+	m := Message{
+		ID:       uuid.New(),
+		Room:     "test",
+		Sender:   a.id,
+		Username: "a",
+		Content:  "hello",
+		Sent:     time.Now(),
+		Clock:    1,
+	}
+	path := versionedPath(negotiateVersion(member.Version), "/rooms/test/message")
+	if err := st.request(http.MethodPost, path, newAPIReqSendMessage(m), nil); err != nil {
+		t.Fatalf("failed to send message over stream: %v", err)
+	}
+	if stored, err := b.getMessage(m.ID); err != nil || stored.Sender != a.id || stored.Content != "hello" {
+		t.Errorf("expected message to be delivered, got %+v (error %v)", stored, err)
+	}
+
+	// the peer can make requests back over the same stream
+	eventually(t, "stream to be accepted", func() bool {
+		b.streams.lock.Lock()
+		defer b.streams.lock.Unlock()
+		return b.streams.streams[a.id] != nil
+	})
+	b.streams.lock.Lock()
+	back := b.streams.streams[a.id]
+	b.streams.lock.Unlock()
+	var caps apiResCapabilities
+	if err := back.request(http.MethodGet, "/capabilities", nil, &caps); err != nil {
+		t.Fatalf("failed to make request back over stream: %v", err)
+	}
+	if !caps.has(capStreams) {
+		t.Errorf("expected peer to support streams, got %+v", caps)
+	}
+
+	// errors are passed back like regular HTTP responses
+	if err := st.request(http.MethodGet, "/nonexistent", nil, nil); err == nil {
+		t.Error("expected request for a nonexistent path to fail")
+	}
+}
+
+func TestStreamWrongPeer(t *testing.T) {
+	a := newTestServer(t, NewMemoryRegistry())
+	c := newTestServer(t, NewMemoryRegistry())
+	trust(t, a, c)
+
+	api := httptest.NewUnstartedServer(c.api.Handler)
+	api.Config.BaseContext = c.api.BaseContext
+	api.TLS = c.api.TLSConfig
+	api.StartTLS()
+	defer api.Close()
+
+	// c is listening at the address advertised for someone else
+	addr := api.Listener.Addr().(*net.TCPAddr)
+	impostor := RoomMember{
+		UUID:     uuid.New(),
+		Addrs:    []net.IP{addr.IP},
+		Port:     addr.Port,
+		Version:  protocolVersion,
+		LastSeen: time.Now(),
+	}
+	a.static.updateMember(impostor, roomAdvert{Rooms: []string{"test"}})
+
+	if err := a.streams.open(a, impostor); err == nil {
+		t.Error("expected stream to a peer with the wrong certificate to fail")
+	}
+	a.streams.lock.Lock()
+	defer a.streams.lock.Unlock()
+	if len(a.streams.streams) != 0 {
+		t.Errorf("expected no streams to be open, got %v", a.streams.streams)
+	}
+}
+
+func TestStreamInFlight(t *testing.T) {
+	registry := NewMemoryRegistry()
+	a := newTestServer(t, registry)
+	b := newTestServer(t, registry)
+	trust(t, a, b)
+
+	uiRequest(t, b, http.MethodPost, "/api/rooms/test", "")
+	eventually(t, "member to be discovered", func() bool {
+		return inRoom(a, "test", b)
+	})
+	member, _ := a.discovery.Lookup(b.id)
+	st, err := a.streams.get(a, member)
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+
+	var accepted *peerStream
+	eventually(t, "stream to be accepted", func() bool {
+		b.streams.lock.Lock()
+		defer b.streams.lock.Unlock()
+		accepted = b.streams.streams[a.id]
+		return accepted != nil
+	})
+
+	// pretend that b is already handling as many requests as it can
+	for i := 0; i < streamMaxInFlight; i++ {
+		accepted.inFlight <- struct{}{}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- st.request(http.MethodGet, "/capabilities", nil, nil)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expected request to wait for a free slot, got response (error %v)", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	<-accepted.inFlight
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("request failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("timed out waiting for request to be handled")
+	}
+}
@@ -5,10 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/devplayer0/cryptochat/internal/data"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/r3labs/sse"
 	log "github.com/sirupsen/logrus"
@@ -16,6 +19,19 @@ import (
 
 const streamVerification = "verification"
 const streamMessages = "messages"
+const streamPresence = "presence"
+const streamRooms = "rooms"
+
+const eventMessageEdit = "edit"
+const eventMessageDelete = "delete"
+const eventMessageExpire = "expire"
+const eventReaction = "reaction"
+const eventRead = "read"
+const eventTyping = "typing"
+const eventStatus = "status"
+const eventManifest = "manifest"
+const eventKick = "kick"
+const eventMetadata = "metadata"
 
 type spaHandler struct {
 	fs    http.Handler
@@ -64,13 +80,18 @@ func (h spaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) publishJSON(stream string, v interface{}) error {
+	return s.publishJSONEvent(stream, "", v)
+}
+
+func (s *Server) publishJSONEvent(stream, event string, v interface{}) error {
 	enc, err := json.Marshal(v)
 	if err != nil {
 		return fmt.Errorf("Failed to encode message payload: %w", err)
 	}
 
 	s.events.Publish(stream, &sse.Event{
-		Data: enc,
+		Event: []byte(event),
+		Data:  enc,
 	})
 	return nil
 }
@@ -113,8 +134,156 @@ func (s *Server) uiVerifyUser(w http.ResponseWriter, r *http.Request) {
 	JSONErrResponse(w, errors.New("user verification not in progress"), http.StatusBadRequest)
 }
 
+type uiEventStatus struct {
+	UUID string `json:"uuid"`
+	Presence
+}
+
+type uiEventTyping struct {
+	UUID string `json:"uuid"`
+	Room string `json:"room"`
+}
+
+type uiEventRoom struct {
+	Room   string      `json:"room"`
+	Member *RoomMember `json:"member,omitempty"`
+}
+
+// publishDiscoveryEvents forwards relevant discovery events to the UI until `events` is closed
+func (s *Server) publishDiscoveryEvents(events <-chan DiscoveryEvent) {
+	for e := range events {
+		switch e.Type {
+		case EventPresenceChanged:
+			s.publishJSONEvent(streamPresence, eventStatus, uiEventStatus{
+				UUID:     e.Member.UUID.String(),
+				Presence: e.Member.Presence,
+			})
+		case EventMemberJoined, EventMemberUpdated, EventMemberLeft:
+			member := e.Member
+			s.publishJSONEvent(streamRooms, string(e.Type), uiEventRoom{
+				Room:   e.Room,
+				Member: &member,
+			})
+		case EventRoomAppeared, EventRoomVanished:
+			s.publishJSONEvent(streamRooms, string(e.Type), uiEventRoom{Room: e.Room})
+		}
+	}
+}
+
+func (s *Server) uiPresence(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var p Presence
+		if err := ParseJSONBody(&p, w, r); err != nil {
+			return
+		}
+		if err := p.validate(); err != nil {
+			JSONErrResponse(w, err, http.StatusBadRequest)
+			return
+		}
+
+		if err := s.savePresence(p); err != nil {
+			JSONErrResponse(w, err, http.StatusInternalServerError)
+			return
+		}
+		s.discovery.SetPresence(p)
+	}
+
+	JSONResponse(w, s.discovery.GetPresence(), http.StatusOK)
+}
+
+func (s *Server) uiTyping(w http.ResponseWriter, r *http.Request) {
+	room := mux.Vars(r)["room"]
+	if s.typingSend.allow(room) {
+		s.sendToRoom(room, http.MethodPost, fmt.Sprintf("/rooms/%v/typing", url.PathEscape(room)), nil)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type uiRoom struct {
+	// Joined indicates whether this user is in the room
+	Joined   bool          `json:"joined"`
+	JoinedAt *time.Time    `json:"joined_at,omitempty"`
+	Members  []RoomMember  `json:"members"`
+	Metadata *RoomMetadata `json:"metadata"`
+}
+
 func (s *Server) uiRooms(w http.ResponseWriter, r *http.Request) {
-	JSONResponse(w, s.discovery.GetRooms(), http.StatusOK)
+	rooms := make(map[string]uiRoom)
+	for name, members := range s.discovery.GetRooms() {
+		rooms[name] = uiRoom{Members: members}
+	}
+	joined, err := s.getJoinedRooms()
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+	for _, j := range joined {
+		j := j
+		room := rooms[j.Room]
+		room.Joined = true
+		room.JoinedAt = &j.Joined
+		if room.Members == nil {
+			room.Members = []RoomMember{}
+		}
+		rooms[j.Room] = room
+	}
+
+	for name, room := range rooms {
+		m, _, err := s.getMetadata(name)
+		if err != nil {
+			JSONErrResponse(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		room.Metadata = m
+		rooms[name] = room
+	}
+
+	JSONResponse(w, rooms, http.StatusOK)
+}
+
+type uiReqStaticPeer struct {
+	Address string `json:"address"`
+}
+
+func (s *Server) uiStaticPeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var req uiReqStaticPeer
+		if err := ParseJSONBody(&req, w, r); err != nil {
+			return
+		}
+		if err := validStaticPeer(req.Address); err != nil {
+			JSONErrResponse(w, fmt.Errorf("invalid peer address: %w", err), http.StatusBadRequest)
+			return
+		}
+
+		added, err := s.addStaticPeer(req.Address)
+		if err != nil {
+			JSONErrResponse(w, err, http.StatusInternalServerError)
+			return
+		}
+		if !added {
+			JSONErrResponse(w, errors.New("peer has already been added"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	JSONResponse(w, s.static.Peers(), http.StatusOK)
+}
+
+func (s *Server) uiStaticPeerRemove(w http.ResponseWriter, r *http.Request) {
+	removed, err := s.removeStaticPeer(mux.Vars(r)["address"])
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		JSONErrResponse(w, errors.New("no such peer"), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (s *Server) uiRoomEdit(w http.ResponseWriter, r *http.Request) {
@@ -122,13 +291,39 @@ func (s *Server) uiRoomEdit(w http.ResponseWriter, r *http.Request) {
 	room := vars["room"]
 
 	switch r.Method {
+	case http.MethodPut:
+		created, err := s.createRoom(room)
+		if errors.Is(err, errRoomExists) {
+			JSONErrResponse(w, err, http.StatusConflict)
+			return
+		}
+		if err != nil {
+			JSONErrResponse(w, err, http.StatusInternalServerError)
+			return
+		}
+		if !created {
+			JSONErrResponse(w, errors.New("already a member of this room"), http.StatusBadRequest)
+			return
+		}
 	case http.MethodPost:
-		if !s.discovery.AddRoom(room) {
+		joined, err := s.joinRoom(room)
+		if err != nil {
+			JSONErrResponse(w, err, http.StatusInternalServerError)
+			return
+		}
+		if !joined {
 			JSONErrResponse(w, errors.New("already a member of this room"), http.StatusBadRequest)
 			return
 		}
+
+		go s.syncRoomHistory(room)
 	case http.MethodDelete:
-		if !s.discovery.RemoveRoom(room) {
+		left, err := s.leaveRoom(room)
+		if err != nil {
+			JSONErrResponse(w, err, http.StatusInternalServerError)
+			return
+		}
+		if !left {
 			JSONErrResponse(w, errors.New("not a member of this room"), http.StatusBadRequest)
 			return
 		}
@@ -142,14 +337,144 @@ type uiMessageSender struct {
 	Username string `json:"username"`
 }
 type uiEventMessage struct {
+	ID     string          `json:"id"`
 	Sender uiMessageSender `json:"sender"`
 
+	Room    string     `json:"room"`
+	Content string     `json:"content"`
+	Time    time.Time  `json:"time"`
+	Edited  *time.Time `json:"edited,omitempty"`
+	Deleted bool       `json:"deleted,omitempty"`
+
+	ReplyTo   string         `json:"reply_to,omitempty"`
+	Thread    string         `json:"thread,omitempty"`
+	Reactions map[string]int `json:"reactions,omitempty"`
+	Expires   *time.Time     `json:"expires,omitempty"`
+	// Clock is the message's Lamport clock; messages are ordered by clock, then sender UUID, then ID
+	Clock int64 `json:"clock"`
+}
+
+func newUIEventMessage(m Message) uiEventMessage {
+	e := uiEventMessage{
+		ID: m.ID.String(),
+		Sender: uiMessageSender{
+			UUID:     m.Sender.String(),
+			Username: m.Username,
+		},
+		Room:    m.Room,
+		Content: m.Content,
+		Time:    m.Sent,
+		Deleted: m.Deleted,
+		Clock:   m.Clock,
+	}
+	if m.Edited.Valid {
+		e.Edited = &m.Edited.Time
+	}
+	if m.ReplyTo != uuid.Nil {
+		e.ReplyTo = m.ReplyTo.String()
+	}
+	if m.Thread != uuid.Nil {
+		e.Thread = m.Thread.String()
+	}
+	if m.Expires.Valid {
+		e.Expires = &m.Expires.Time
+	}
+
+	return e
+}
+
+type uiEventExpire struct {
+	ID   string `json:"id"`
+	Room string `json:"room"`
+}
+
+type uiEventReaction struct {
 	Room    string `json:"room"`
-	Content string `json:"content"`
+	Message string `json:"message"`
+	User    string `json:"user"`
+	Emoji   string `json:"emoji"`
+	Added   bool   `json:"added"`
+	Count   int    `json:"count"`
+}
+
+// sendToRoom makes a request to every known member of a room, returning the members which could not be reached
+func (s *Server) sendToRoom(room, method, path string, body interface{}) []RoomMember {
+	rooms := s.discovery.GetRooms()
+	members, ok := rooms[room]
+	if !ok {
+		// nobody in this room
+		return nil
+	}
+
+	var failed []RoomMember
+	for _, m := range members {
+		if err := s.sendToMember(room, m, method, path, body); err != nil {
+			log.WithFields(log.Fields{
+				"id":        m.UUID.String(),
+				"addresses": m.Addrs,
+				"room":      room,
+			}).WithError(err).Error("Failed to send request to room member")
+			failed = append(failed, m)
+		}
+	}
+
+	return failed
+}
+
+// sendToMember makes a request to a room member, refusing delivery to banned users and only delivering to members of
+// protected rooms who know the room's secret
+func (s *Server) sendToMember(room string, m RoomMember, method, path string, body interface{}) error {
+	return s.requestMember(room, m, method, path, body, nil)
+}
+
+// requestMember makes a request to a room member as in sendToMember, decoding the response into `res` (if not nil)
+func (s *Server) requestMember(room string, m RoomMember, method, path string, body, res interface{}) error {
+	banned, err := s.isBanned(room, m.UUID)
+	if err != nil {
+		return err
+	}
+	if banned {
+		log.WithFields(log.Fields{
+			"id":   m.UUID.String(),
+			"room": room,
+		}).Debug("Not sending to banned user")
+		return nil
+	}
+
+	caps := s.peerCapabilities(m)
+	if b, ok := body.(peerBody); ok {
+		if body, ok = b.forPeer(caps); !ok {
+			log.WithFields(log.Fields{
+				"id":   m.UUID.String(),
+				"room": room,
+				"path": path,
+			}).Debug("Not sending request unsupported by peer")
+			return nil
+		}
+	}
+
+	secret, err := s.getRoomSecret(room)
+	if err != nil {
+		return err
+	}
+	if secret != nil && !s.auth.isProven(m.UUID, room) {
+		if err := s.authenticate(m, room, secret); err != nil {
+			return fmt.Errorf("failed to authenticate room member: %w", err)
+		}
+	}
+
+	return s.peerRequest(m, caps, method, path, body, res)
+}
+
+type uiReqSendMessage struct {
+	Username string `json:"username"`
+	Content  string `json:"content"`
+	ReplyTo  string `json:"reply_to,omitempty"`
+	TTL      int    `json:"ttl,omitempty"`
 }
 
 func (s *Server) uiSendMessage(w http.ResponseWriter, r *http.Request) {
-	var req apiReqSendMessage
+	var req uiReqSendMessage
 	if err := ParseJSONBody(&req, w, r); err != nil {
 		return
 	}
@@ -157,24 +482,610 @@ func (s *Server) uiSendMessage(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	room := vars["room"]
 
-	rooms := s.discovery.GetRooms()
-	members, ok := rooms[room]
+	m := Message{
+		ID:       uuid.New(),
+		Room:     room,
+		Sender:   s.id,
+		Username: req.Username,
+		Content:  req.Content,
+		Sent:     time.Now(),
+	}
+
+	if req.ReplyTo != "" {
+		id, err := uuid.Parse(req.ReplyTo)
+		if err != nil {
+			JSONErrResponse(w, fmt.Errorf("failed to parse reply message ID: %w", err), http.StatusBadRequest)
+			return
+		}
+
+		parent, err := s.getMessage(id)
+		if errors.Is(err, errMessageNotFound) || (err == nil && parent.Room != room) {
+			JSONErrResponse(w, errors.New("message being replied to not found"), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			JSONErrResponse(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		m.ReplyTo = parent.ID
+		m.Thread = threadFor(parent)
+	}
+
+	ttl := req.TTL
+	if ttl == 0 {
+		settings, err := s.loadRoomSettings(room)
+		if err != nil {
+			JSONErrResponse(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		ttl = settings.TTL
+	}
+	m.setTTL(ttl)
+
+	s.clockLock.Lock()
+	var err error
+	if m.Clock, err = s.nextClock(room); err != nil {
+		s.clockLock.Unlock()
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+	if m.Signature, err = s.sign(m.signingData()); err != nil {
+		s.clockLock.Unlock()
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = s.addMessage(m)
+	s.clockLock.Unlock()
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+	s.publishJSON(streamMessages, newUIEventMessage(m))
+
+	b := newAPIReqSendMessage(m)
+	failed := s.sendToRoom(room, http.MethodPost, fmt.Sprintf("/rooms/%v/message", url.PathEscape(room)), b)
+	if len(failed) != 0 {
+		go s.relayMessage(room, b, failed)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newUIMessageList(messages []Message, reactions reactionCounts) []uiEventMessage {
+	list := make([]uiEventMessage, len(messages))
+	for i, m := range messages {
+		list[i] = newUIEventMessage(m)
+		list[i].Reactions = reactions[m.ID]
+	}
+
+	return list
+}
+
+func (s *Server) uiRoomHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	history, err := s.getRoomHistory(vars["room"])
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	reactions, err := s.getRoomReactions(vars["room"])
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	JSONResponse(w, newUIMessageList(history, reactions), http.StatusOK)
+}
+
+func (s *Server) uiThread(w http.ResponseWriter, r *http.Request) {
+	root, ok := s.roomMessage(w, r)
 	if !ok {
-		// nobody in this room
+		return
+	}
+
+	replies, err := s.getThread(root.ID)
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	reactions, err := s.getRoomReactions(root.Room)
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	JSONResponse(w, newUIMessageList(append([]Message{root}, replies...), reactions), http.StatusOK)
+}
+
+func (s *Server) uiReact(w http.ResponseWriter, r *http.Request) {
+	m, ok := s.roomMessage(w, r)
+	if !ok {
+		return
+	}
+
+	if !s.applyReaction(w, r, m, s.id) {
+		return
+	}
+
+	s.sendToRoom(m.Room, r.Method, fmt.Sprintf("/rooms/%v/messages/%v/reactions/%v", url.PathEscape(m.Room), m.ID,
+		url.PathEscape(mux.Vars(r)["emoji"])), nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type uiReqEditMessage struct {
+	Content string `json:"content"`
+}
+
+func (s *Server) uiMessageEdit(w http.ResponseWriter, r *http.Request) {
+	var req uiReqEditMessage
+	if r.Method == http.MethodPut {
+		if err := ParseJSONBody(&req, w, r); err != nil {
+			return
+		}
+	}
+
+	m, ok := s.authoredMessage(w, r, s.id)
+	if !ok {
+		return
+	}
+
+	b := apiReqEditMessage{
+		Time:    time.Now(),
+		Content: req.Content,
+	}
+	if !s.applyMessageEdit(w, r, &m, b) {
+		return
+	}
+
+	s.sendToRoom(m.Room, r.Method, fmt.Sprintf("/rooms/%v/messages/%v", url.PathEscape(m.Room), m.ID), b)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type uiMessageEdit struct {
+	Content string    `json:"content"`
+	Time    time.Time `json:"time"`
+}
+
+func (s *Server) uiMessageEdits(w http.ResponseWriter, r *http.Request) {
+	m, ok := s.roomMessage(w, r)
+	if !ok {
+		return
+	}
+
+	edits, err := s.getMessageEdits(m.ID)
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	res := make([]uiMessageEdit, len(edits))
+	for i, e := range edits {
+		res[i] = uiMessageEdit{
+			Content: e.Content,
+			Time:    e.Time,
+		}
+	}
+	JSONResponse(w, res, http.StatusOK)
+}
+
+type uiEventRead struct {
+	UUID    string `json:"uuid"`
+	Room    string `json:"room"`
+	Message string `json:"message"`
+}
+
+type uiReqRead struct {
+	Message string `json:"message"`
+}
+
+func (s *Server) uiMarkRead(w http.ResponseWriter, r *http.Request) {
+	var req uiReqRead
+	if err := ParseJSONBody(&req, w, r); err != nil {
+		return
+	}
+
+	m, ok := s.findRoomMessage(w, req.Message, mux.Vars(r)["room"])
+	if !ok {
+		return
+	}
+
+	if err := s.setReadMarker(m); err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	settings, err := s.loadSettings()
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+	if settings.ReadReceipts {
+		s.sendToRoom(m.Room, http.MethodPost, fmt.Sprintf("/rooms/%v/read", url.PathEscape(m.Room)), apiReqReadReceipt{
+			Message: m.ID.String(),
+		})
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type uiUnreadInfo struct {
+	Count       int    `json:"count"`
+	FirstUnread string `json:"first_unread"`
+}
+
+func (s *Server) uiUnread(w http.ResponseWriter, r *http.Request) {
+	unread, err := s.getUnread()
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	res := make(map[string]uiUnreadInfo)
+	for room, info := range unread {
+		res[room] = uiUnreadInfo{
+			Count:       info.Count,
+			FirstUnread: info.FirstUnread.String(),
+		}
+	}
+	JSONResponse(w, res, http.StatusOK)
+}
+
+func (s *Server) uiReadReceipts(w http.ResponseWriter, r *http.Request) {
+	m, ok := s.roomMessage(w, r)
+	if !ok {
+		return
+	}
+
+	users, err := s.getReadReceipts(m.ID)
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	res := make([]string, len(users))
+	for i, u := range users {
+		res[i] = u.String()
+	}
+	JSONResponse(w, res, http.StatusOK)
+}
+
+func (s *Server) uiSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var settings Settings
+		if err := ParseJSONBody(&settings, w, r); err != nil {
+			return
+		}
+
+		if err := s.saveSettings(settings); err != nil {
+			JSONErrResponse(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	settings, err := s.loadSettings()
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+	JSONResponse(w, settings, http.StatusOK)
+}
+
+func (s *Server) uiRoomSettings(w http.ResponseWriter, r *http.Request) {
+	room := mux.Vars(r)["room"]
+	if r.Method == http.MethodPut {
+		var settings RoomSettings
+		if err := ParseJSONBody(&settings, w, r); err != nil {
+			return
+		}
+		if settings.TTL < 0 {
+			JSONErrResponse(w, errors.New("TTL must not be negative"), http.StatusBadRequest)
+			return
+		}
+
+		if err := s.saveRoomSettings(room, settings); err != nil {
+			JSONErrResponse(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	settings, err := s.loadRoomSettings(room)
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+	JSONResponse(w, settings, http.StatusOK)
+}
+
+type uiRoomSecret struct {
+	Private bool `json:"private"`
+	// Secret is the room's base64-encoded secret (generated if not provided when making a room private)
+	Secret []byte `json:"secret,omitempty"`
+}
+
+func (s *Server) uiRoomSecret(w http.ResponseWriter, r *http.Request) {
+	room := mux.Vars(r)["room"]
+	switch r.Method {
+	case http.MethodPut:
+		var req uiRoomSecret
+		if err := ParseJSONBody(&req, w, r); err != nil {
+			return
+		}
+
+		if req.Secret == nil {
+			var err error
+			if req.Secret, err = generateRoomSecret(); err != nil {
+				JSONErrResponse(w, err, http.StatusInternalServerError)
+				return
+			}
+		} else if len(req.Secret) < roomTagSize {
+			JSONErrResponse(w, fmt.Errorf("room secret must be at least %v bytes", roomTagSize), http.StatusBadRequest)
+			return
+		}
+
+		if err := s.setRoomSecret(room, req.Secret); err != nil {
+			JSONErrResponse(w, err, http.StatusInternalServerError)
+			return
+		}
+	case http.MethodDelete:
+		if err := s.setRoomSecret(room, nil); err != nil {
+			JSONErrResponse(w, err, http.StatusInternalServerError)
+			return
+		}
+
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
-	for _, m := range members {
-		if err := JSONReq(s.client, http.MethodPost, fmt.Sprintf("https://%v:%v/rooms/%v/message", m.Addr.IP,
-			m.Addr.Port, vars["room"]), req, nil); err != nil {
-			log.WithFields(log.Fields{
-				"id":      m.UUID.String(),
-				"address": m.Addr,
-				"room":    room,
-			}).WithError(err).Error("Failed to send message to room member")
+	secret, err := s.getRoomSecret(room)
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+	JSONResponse(w, uiRoomSecret{
+		Private: secret != nil,
+		Secret:  secret,
+	}, http.StatusOK)
+}
+
+type uiReqInvite struct {
+	// TTL is the number of seconds the invite is valid for
+	TTL int `json:"ttl"`
+}
+
+type uiInvite struct {
+	Room  string `json:"room"`
+	Token string `json:"token,omitempty"`
+}
+
+func (s *Server) uiCreateInvite(w http.ResponseWriter, r *http.Request) {
+	var req uiReqInvite
+	if err := ParseJSONBody(&req, w, r); err != nil {
+		return
+	}
+	if req.TTL < 0 {
+		JSONErrResponse(w, errors.New("TTL must not be negative"), http.StatusBadRequest)
+		return
+	}
+
+	validFor := defaultInviteValidity
+	if req.TTL != 0 {
+		validFor = time.Duration(req.TTL) * time.Second
+	}
+
+	room := mux.Vars(r)["room"]
+	token, err := s.createInvite(room, validFor)
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusBadRequest)
+		return
+	}
+
+	JSONResponse(w, uiInvite{Room: room, Token: token}, http.StatusCreated)
+}
+
+// uiRedeemInvite joins the protected room an invite token is for
+func (s *Server) uiRedeemInvite(w http.ResponseWriter, r *http.Request) {
+	var req uiInvite
+	if err := ParseJSONBody(&req, w, r); err != nil {
+		return
+	}
+
+	invite, err := s.parseInvite(req.Token)
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := s.setRoomSecret(invite.Room, invite.Secret); err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+	if invite.Creator != uuid.Nil {
+		if err := s.setRoomCreator(invite.Room, invite.Creator); err != nil {
+			JSONErrResponse(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	if _, err := s.joinRoom(invite.Room); err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	JSONResponse(w, uiInvite{Room: invite.Room}, http.StatusOK)
+}
+
+type uiReqManifest struct {
+	Admins *[]uuid.UUID `json:"admins"`
+}
+
+func (s *Server) uiManifest(w http.ResponseWriter, r *http.Request) {
+	room := mux.Vars(r)["room"]
+	if r.Method == http.MethodPut {
+		var req uiReqManifest
+		if err := ParseJSONBody(&req, w, r); err != nil {
+			return
+		}
+
+		m, err := s.updateManifest(room, func(m *RoomManifest) error {
+			if req.Admins != nil {
+				if m.Owner != s.id {
+					return errors.New("only the owner can change admins")
+				}
+				if hasDuplicateUUIDs(*req.Admins) {
+					return errors.New("admins cannot be listed more than once")
+				}
+
+				m.Admins = *req.Admins
+			}
+			return nil
+		})
+		if errors.Is(err, errNotAdmin) || errors.Is(err, errNotCreator) {
+			JSONErrResponse(w, err, http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			JSONErrResponse(w, err, http.StatusBadRequest)
+			return
+		}
+
+		JSONResponse(w, m, http.StatusOK)
+		return
+	}
+
+	m, _, err := s.getManifest(room)
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+	if m == nil {
+		JSONErrResponse(w, errors.New("room has no manifest"), http.StatusNotFound)
+		return
+	}
+	JSONResponse(w, m, http.StatusOK)
+}
+
+type uiReqMetadata struct {
+	Topic       *string `json:"topic"`
+	Description *string `json:"description"`
+	IconHash    *string `json:"icon_hash"`
+}
+
+func (s *Server) uiMetadata(w http.ResponseWriter, r *http.Request) {
+	room := mux.Vars(r)["room"]
+	if r.Method == http.MethodPut {
+		var req uiReqMetadata
+		if err := ParseJSONBody(&req, w, r); err != nil {
+			return
 		}
+
+		if !s.discovery.IsMember(room) {
+			JSONErrResponse(w, errors.New("not a member of this room"), http.StatusBadRequest)
+			return
+		}
+
+		m, err := s.updateMetadata(room, func(m *RoomMetadata) {
+			if req.Topic != nil {
+				m.Topic = *req.Topic
+			}
+			if req.Description != nil {
+				m.Description = *req.Description
+			}
+			if req.IconHash != nil {
+				m.IconHash = *req.IconHash
+			}
+		})
+		if errors.Is(err, errNotAdmin) {
+			JSONErrResponse(w, err, http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			JSONErrResponse(w, err, http.StatusBadRequest)
+			return
+		}
+
+		JSONResponse(w, m, http.StatusOK)
+		return
+	}
+
+	m, _, err := s.getMetadata(room)
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusInternalServerError)
+		return
+	}
+	if m == nil {
+		JSONErrResponse(w, errors.New("room has no metadata"), http.StatusNotFound)
+		return
+	}
+	JSONResponse(w, m, http.StatusOK)
+}
+
+// roomTarget parses the room and target user of a moderation request
+func roomTarget(w http.ResponseWriter, r *http.Request) (string, uuid.UUID, bool) {
+	vars := mux.Vars(r)
+	id, err := uuid.Parse(vars["uuid"])
+	if err != nil {
+		JSONErrResponse(w, fmt.Errorf("failed to parse UUID: %w", err), http.StatusBadRequest)
+		return "", id, false
+	}
+
+	return vars["room"], id, true
+}
+
+func (s *Server) uiKick(w http.ResponseWriter, r *http.Request) {
+	room, target, ok := roomTarget(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.kick(room, target); err != nil {
+		JSONErrResponse(w, err, http.StatusForbidden)
+		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+func (s *Server) uiBan(w http.ResponseWriter, r *http.Request) {
+	room, target, ok := roomTarget(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		// remove the user from the room before they stop receiving anything from it (kick checks that this user is
+		// allowed to remove them before sending anything)
+		if err := s.kick(room, target); err != nil {
+			JSONErrResponse(w, err, http.StatusForbidden)
+			return
+		}
+	}
+
+	m, err := s.updateManifest(room, func(m *RoomManifest) error {
+		if err := m.canRemove(s.id, target); err != nil {
+			return err
+		}
+
+		banned := []uuid.UUID{}
+		for _, id := range m.Banned {
+			if id != target {
+				banned = append(banned, id)
+			}
+		}
+		if r.Method == http.MethodPut {
+			banned = append(banned, target)
+		}
+
+		m.Banned = banned
+		return nil
+	})
+	if err != nil {
+		JSONErrResponse(w, err, http.StatusForbidden)
+		return
+	}
+
+	JSONResponse(w, m, http.StatusOK)
+}